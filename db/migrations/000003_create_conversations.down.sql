@@ -0,0 +1,14 @@
+BEGIN;
+  -- Group messages can't be represented without conversations
+  DELETE FROM text_message USING message WHERE text_message.message_id = message.id AND message.recipient_id IS NULL;
+  DELETE FROM image_message USING message WHERE image_message.message_id = message.id AND message.recipient_id IS NULL;
+  DELETE FROM video_message USING message WHERE video_message.message_id = message.id AND message.recipient_id IS NULL;
+  DELETE FROM message WHERE recipient_id IS NULL;
+
+  ALTER TABLE message ALTER COLUMN recipient_id SET NOT NULL;
+  DROP INDEX IF EXISTS message_conversation_id_id_idx;
+  ALTER TABLE message DROP COLUMN IF EXISTS conversation_id;
+
+  DROP TABLE IF EXISTS conversation_member;
+  DROP TABLE IF EXISTS conversation;
+COMMIT;
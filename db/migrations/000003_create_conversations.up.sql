@@ -0,0 +1,53 @@
+BEGIN;
+
+  CREATE TABLE IF NOT EXISTS conversation(
+    id bigserial PRIMARY KEY,
+    -- NULL for direct conversations, which are named after the other member
+    name TEXT,
+    -- "<lower user id>:<higher user id>" for direct conversations so that each
+    -- pair of users only ever has one. NULL for group conversations.
+    direct_key TEXT UNIQUE,
+    created_by bigint REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+  );
+
+  CREATE TABLE IF NOT EXISTS conversation_member(
+    conversation_id bigint NOT NULL REFERENCES conversation(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id)
+  );
+
+  CREATE INDEX conversation_member_user_id_idx ON conversation_member (user_id);
+
+  ALTER TABLE message ADD COLUMN conversation_id bigint REFERENCES conversation(id) ON UPDATE CASCADE;
+
+  -- Every existing message was a direct message, so each pair of users that
+  -- has talked becomes an implicit two person conversation
+  INSERT INTO conversation (direct_key, created_at)
+    SELECT least(sender_id, recipient_id) || ':' || greatest(sender_id, recipient_id), min(created_at)
+      FROM message
+      GROUP BY least(sender_id, recipient_id), greatest(sender_id, recipient_id);
+
+  INSERT INTO conversation_member (conversation_id, user_id, joined_at)
+    SELECT id, split_part(direct_key, ':', 1)::bigint, created_at
+      FROM conversation
+      WHERE direct_key IS NOT NULL
+    UNION
+    SELECT id, split_part(direct_key, ':', 2)::bigint, created_at
+      FROM conversation
+      WHERE direct_key IS NOT NULL;
+
+  UPDATE message
+    SET conversation_id = conversation.id
+    FROM conversation
+    WHERE conversation.direct_key = least(message.sender_id, message.recipient_id) || ':' || greatest(message.sender_id, message.recipient_id);
+
+  ALTER TABLE message ALTER COLUMN conversation_id SET NOT NULL;
+
+  -- Messages in group conversations don't have a single recipient
+  ALTER TABLE message ALTER COLUMN recipient_id DROP NOT NULL;
+
+  CREATE INDEX message_conversation_id_id_idx ON message (conversation_id, id);
+
+COMMIT;
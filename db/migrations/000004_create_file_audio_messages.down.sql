@@ -0,0 +1,11 @@
+BEGIN;
+  DROP TABLE IF EXISTS audio_message;
+  DROP TABLE IF EXISTS file_message;
+  DROP TABLE IF EXISTS blob;
+
+  -- File and audio messages have no content left to show
+  DELETE FROM message USING message_type
+    WHERE message.message_type_id = message_type.id
+      AND message_type.name IN ('file', 'audio');
+  DELETE FROM message_type WHERE name IN ('file', 'audio');
+COMMIT;
@@ -0,0 +1,37 @@
+BEGIN;
+
+  CREATE TABLE IF NOT EXISTS blob(
+    id uuid PRIMARY KEY,
+    uploader_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE,
+    filename TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size bigint NOT NULL,
+    -- Hex encoded SHA-256 of the contents
+    checksum TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+  );
+
+  CREATE INDEX blob_uploader_id_idx ON blob (uploader_id);
+
+  INSERT INTO message_type(name) VALUES ('file'), ('audio') ON CONFLICT (name) DO NOTHING;
+
+  CREATE TABLE IF NOT EXISTS file_message(
+    id bigserial PRIMARY KEY,
+    message_id bigint NOT NULL REFERENCES message(id) ON UPDATE CASCADE,
+    blob_id uuid NOT NULL REFERENCES blob(id) ON UPDATE CASCADE
+  );
+
+  CREATE INDEX file_message_message_id_idx ON file_message (message_id);
+  CREATE INDEX file_message_blob_id_idx ON file_message (blob_id);
+
+  CREATE TABLE IF NOT EXISTS audio_message(
+    id bigserial PRIMARY KEY,
+    message_id bigint NOT NULL REFERENCES message(id) ON UPDATE CASCADE,
+    blob_id uuid NOT NULL REFERENCES blob(id) ON UPDATE CASCADE,
+    duration_ms integer NOT NULL CONSTRAINT duration_ms_check CHECK (duration_ms > 0)
+  );
+
+  CREATE INDEX audio_message_message_id_idx ON audio_message (message_id);
+  CREATE INDEX audio_message_blob_id_idx ON audio_message (blob_id);
+
+COMMIT;
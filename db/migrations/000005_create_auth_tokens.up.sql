@@ -0,0 +1,17 @@
+BEGIN;
+
+  CREATE TABLE IF NOT EXISTS auth_token(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    -- SHA-256 of the opaque token. The token itself is only ever known by the
+    -- client that it was issued to.
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+  );
+
+  CREATE INDEX auth_token_user_id_idx ON auth_token (user_id);
+  CREATE INDEX auth_token_expires_at_idx ON auth_token (expires_at);
+
+COMMIT;
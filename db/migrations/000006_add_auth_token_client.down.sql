@@ -0,0 +1,5 @@
+BEGIN;
+  ALTER TABLE auth_token DROP COLUMN IF EXISTS user_agent;
+  ALTER TABLE auth_token DROP COLUMN IF EXISTS ip;
+  ALTER TABLE auth_token DROP COLUMN IF EXISTS last_seen_at;
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+  -- Each token is a login session, so remember enough about the client that a
+  -- user can recognize it in their list of sessions
+  ALTER TABLE auth_token ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+  ALTER TABLE auth_token ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+  ALTER TABLE auth_token ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+
+COMMIT;
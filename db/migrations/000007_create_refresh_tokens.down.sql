@@ -0,0 +1,4 @@
+BEGIN;
+  DROP TABLE IF EXISTS refresh_token;
+  ALTER TABLE auth_token DROP COLUMN IF EXISTS access_expires_at;
+COMMIT;
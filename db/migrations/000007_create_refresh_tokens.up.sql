@@ -0,0 +1,24 @@
+BEGIN;
+
+  -- auth_token.token_hash is now a short lived access token. The row itself
+  -- is the login session, which lives until auth_token.expires_at and is
+  -- extended every time it's refreshed.
+  ALTER TABLE auth_token ADD COLUMN access_expires_at TIMESTAMPTZ;
+  UPDATE auth_token SET access_expires_at = expires_at;
+  ALTER TABLE auth_token ALTER COLUMN access_expires_at SET NOT NULL;
+
+  -- Every refresh token of a session belongs to the same family. Each one can
+  -- only be used once, and using one twice revokes the session.
+  CREATE TABLE IF NOT EXISTS refresh_token(
+    id bigserial PRIMARY KEY,
+    session_id bigint NOT NULL REFERENCES auth_token(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    -- SHA-256 of the opaque token
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+  );
+
+  CREATE INDEX refresh_token_session_id_idx ON refresh_token (session_id);
+
+COMMIT;
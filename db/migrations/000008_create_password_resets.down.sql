@@ -0,0 +1,5 @@
+BEGIN;
+  DROP TABLE IF EXISTS password_reset;
+  DROP INDEX IF EXISTS chat_user_email_key;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS email;
+COMMIT;
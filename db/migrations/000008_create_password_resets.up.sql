@@ -0,0 +1,19 @@
+BEGIN;
+
+  -- Optional, but password resets can only be requested for users with one
+  ALTER TABLE chat_user ADD COLUMN email TEXT;
+  CREATE UNIQUE INDEX chat_user_email_key ON chat_user (lower(email));
+
+  CREATE TABLE IF NOT EXISTS password_reset(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    -- SHA-256 of the opaque token that was emailed to the user
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+  );
+
+  CREATE INDEX password_reset_user_id_idx ON password_reset (user_id);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+  DROP TABLE IF EXISTS recovery_code;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS totp_last_step;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS totp_enabled_at;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS totp_secret;
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+
+  -- The base32 TOTP secret. It's set during enrollment, but two factor
+  -- authentication is only on once totp_enabled_at is set.
+  ALTER TABLE chat_user ADD COLUMN totp_secret TEXT;
+  ALTER TABLE chat_user ADD COLUMN totp_enabled_at TIMESTAMPTZ;
+  -- The last time step that a code was accepted for, so that a code can't be
+  -- used twice
+  ALTER TABLE chat_user ADD COLUMN totp_last_step bigint;
+
+  CREATE TABLE IF NOT EXISTS recovery_code(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    -- SHA-256 of the normalized code
+    code_hash BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMPTZ
+  );
+
+  CREATE INDEX recovery_code_user_id_idx ON recovery_code (user_id);
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+  -- Failed logins, two factor codes and password reset requests per user,
+  -- email and IP, shared by every replica
+  CREATE TABLE IF NOT EXISTS login_attempt(
+    -- Which kind of key it is, then what it's for, like
+    -- "username:<lowercased username>" or "ip:<address>"
+    key TEXT PRIMARY KEY,
+    failures integer NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ
+  );
+
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+  -- NOT VALID so that existing argon2id hashes don't block the rollback
+  ALTER TABLE chat_user ADD CONSTRAINT password_check CHECK (char_length(password) <= 72) NOT VALID;
+COMMIT;
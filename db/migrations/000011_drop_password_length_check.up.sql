@@ -0,0 +1,7 @@
+BEGIN;
+
+  -- The check was meant for bcrypt hashes. argon2id hashes are longer and
+  -- carry their parameters with them.
+  ALTER TABLE chat_user DROP CONSTRAINT IF EXISTS password_check;
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+  -- Accounts at OpenID Connect providers that users sign in with. The subject
+  -- is only unique within its issuer.
+  CREATE TABLE IF NOT EXISTS user_identity(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (issuer, subject)
+  );
+
+  CREATE INDEX user_identity_user_id_idx ON user_identity (user_id);
+
+COMMIT;
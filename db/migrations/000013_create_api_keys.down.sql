@@ -0,0 +1,4 @@
+BEGIN;
+  DROP TABLE IF EXISTS api_key;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS owner_id;
+COMMIT;
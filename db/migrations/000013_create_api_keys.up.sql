@@ -0,0 +1,26 @@
+BEGIN;
+
+  -- Service accounts are users that bots and CI act as. They never log in
+  -- and only authenticate with API keys. owner_id is the user who manages
+  -- the account, and is NULL for everyone else.
+  ALTER TABLE chat_user ADD COLUMN owner_id bigint REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+  CREATE INDEX chat_user_owner_id_idx ON chat_user (owner_id);
+
+  CREATE TABLE IF NOT EXISTS api_key(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    -- SHA-256 of the key. The key itself is only shown once, when it's
+    -- created.
+    key_hash BYTEA NOT NULL UNIQUE,
+    -- What the key is allowed to do, such as messages:write
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+  );
+
+  CREATE INDEX api_key_user_id_idx ON api_key (user_id);
+
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS disabled_at;
+  ALTER TABLE chat_user DROP COLUMN IF EXISTS role;
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+  -- What a user is allowed to do beyond their own account. Permissions per
+  -- role are defined by the API server.
+  ALTER TABLE chat_user ADD COLUMN role TEXT NOT NULL DEFAULT 'user'
+    CONSTRAINT role_check CHECK (role IN ('user', 'moderator', 'admin'));
+
+  -- Disabled users can't log in, and their existing sessions and API keys
+  -- are refused until they're enabled again
+  ALTER TABLE chat_user ADD COLUMN disabled_at TIMESTAMPTZ;
+
+COMMIT;
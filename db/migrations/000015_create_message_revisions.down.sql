@@ -0,0 +1,4 @@
+BEGIN;
+  DROP TABLE IF EXISTS message_revision;
+  ALTER TABLE message DROP COLUMN IF EXISTS edited_at;
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+  -- When the message was last edited, or NULL if it never was
+  ALTER TABLE message ADD COLUMN edited_at TIMESTAMPTZ;
+
+  -- Every version of a message's text that was replaced by an edit. The
+  -- current version stays in text_message.
+  CREATE TABLE IF NOT EXISTS message_revision(
+    id bigserial PRIMARY KEY,
+    message_id bigint NOT NULL REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    text TEXT NOT NULL,
+    -- When this version was written, which is when the message was created
+    -- for the first version
+    created_at TIMESTAMPTZ NOT NULL
+  );
+
+  CREATE INDEX message_revision_message_id_idx ON message_revision (message_id, id);
+
+COMMIT;
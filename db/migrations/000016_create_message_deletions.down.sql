@@ -0,0 +1,19 @@
+BEGIN;
+  ALTER TABLE audio_message
+    DROP CONSTRAINT audio_message_message_id_fkey,
+    ADD CONSTRAINT audio_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE;
+  ALTER TABLE file_message
+    DROP CONSTRAINT file_message_message_id_fkey,
+    ADD CONSTRAINT file_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE;
+  ALTER TABLE video_message
+    DROP CONSTRAINT video_message_message_id_fkey,
+    ADD CONSTRAINT video_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE;
+  ALTER TABLE image_message
+    DROP CONSTRAINT image_message_message_id_fkey,
+    ADD CONSTRAINT image_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE;
+  ALTER TABLE text_message
+    DROP CONSTRAINT text_message_message_id_fkey,
+    ADD CONSTRAINT text_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE;
+  DROP TABLE IF EXISTS message_hide;
+  ALTER TABLE message DROP COLUMN IF EXISTS deleted_at;
+COMMIT;
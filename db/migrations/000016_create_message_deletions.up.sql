@@ -0,0 +1,34 @@
+BEGIN;
+
+  -- When the sender deleted the message for everyone, or NULL if they didn't.
+  -- Deleted messages stay behind as tombstones without any content.
+  ALTER TABLE message ADD COLUMN deleted_at TIMESTAMPTZ;
+
+  -- Messages that a user deleted only for themselves
+  CREATE TABLE IF NOT EXISTS message_hide(
+    message_id bigint NOT NULL REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    hidden_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id)
+  );
+
+  CREATE INDEX message_hide_user_id_idx ON message_hide (user_id);
+
+  -- Content goes away along with its message
+  ALTER TABLE text_message
+    DROP CONSTRAINT text_message_message_id_fkey,
+    ADD CONSTRAINT text_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE;
+  ALTER TABLE image_message
+    DROP CONSTRAINT image_message_message_id_fkey,
+    ADD CONSTRAINT image_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE;
+  ALTER TABLE video_message
+    DROP CONSTRAINT video_message_message_id_fkey,
+    ADD CONSTRAINT video_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE;
+  ALTER TABLE file_message
+    DROP CONSTRAINT file_message_message_id_fkey,
+    ADD CONSTRAINT file_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE;
+  ALTER TABLE audio_message
+    DROP CONSTRAINT audio_message_message_id_fkey,
+    ADD CONSTRAINT audio_message_message_id_fkey FOREIGN KEY (message_id) REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+  -- Each user can react to a message with each emoji once
+  CREATE TABLE IF NOT EXISTS message_reaction(
+    message_id bigint NOT NULL REFERENCES message(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES chat_user(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id, emoji)
+  );
+
+  CREATE INDEX message_reaction_user_id_idx ON message_reaction (user_id);
+
+COMMIT;
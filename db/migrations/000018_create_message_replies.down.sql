@@ -0,0 +1,5 @@
+BEGIN;
+  ALTER TABLE message DROP COLUMN IF EXISTS reply_count;
+  ALTER TABLE message DROP COLUMN IF EXISTS root_id;
+  ALTER TABLE message DROP COLUMN IF EXISTS reply_to_id;
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+  -- The message that this one replies to
+  ALTER TABLE message ADD COLUMN reply_to_id bigint REFERENCES message(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+  -- The first message of the thread that this reply is in. Replies to
+  -- replies stay in their parent's thread.
+  ALTER TABLE message ADD COLUMN root_id bigint REFERENCES message(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+  -- How many replies are in the thread that this message starts, kept up to
+  -- date as replies are written so that listings don't have to count them
+  ALTER TABLE message ADD COLUMN reply_count integer NOT NULL DEFAULT 0;
+
+  CREATE INDEX message_root_id_idx ON message (root_id, id);
+  CREATE INDEX message_reply_to_id_idx ON message (reply_to_id);
+
+COMMIT;
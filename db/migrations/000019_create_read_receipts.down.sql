@@ -0,0 +1,3 @@
+BEGIN;
+  ALTER TABLE conversation_member DROP COLUMN IF EXISTS last_read_id;
+COMMIT;
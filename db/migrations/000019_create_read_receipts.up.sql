@@ -0,0 +1,16 @@
+BEGIN;
+
+  -- The newest message in the conversation that the member has read. Every
+  -- message up to and including it counts as read. Unread counts are worked
+  -- out from it when they're asked for.
+  ALTER TABLE conversation_member ADD COLUMN last_read_id bigint NOT NULL DEFAULT 0;
+
+  -- Everything that was sent before read receipts existed counts as read
+  UPDATE conversation_member
+    SET last_read_id = coalesce((
+      SELECT max(message.id)
+        FROM message
+        WHERE message.conversation_id = conversation_member.conversation_id
+    ), 0);
+
+COMMIT;
@@ -44,14 +44,32 @@ const image = repository.buildAndPushImage({
   args: { BUILDKIT_INLINE_CACHE: '1' },
 });
 
+// Every replica serves every blob, so uploads go to a volume that all of them
+// mount. gp2 volumes can only be attached to one node, so this needs a storage
+// class that supports ReadWriteMany, like EFS.
+const blobs = new kx.PersistentVolumeClaim("blobs", {
+  metadata: {
+    namespace: namespace.metadata.name,
+  },
+  spec: {
+    accessModes: ["ReadWriteMany"],
+    storageClassName: config.get("blobStorageClass") || "efs-sc",
+    resources: { requests: { storage: "10Gi" } },
+  },
+});
+
 const pod = new kx.PodBuilder({
   containers: [
     {
       env: {
         CHAT_PG_HOST: "postgres-postgresql",
         CHAT_PG_PASSWORD: config.requireSecret("postgresPassword"),
+        // Traefik runs inside the cluster, so requests reach us from the pod network
+        CHAT_TRUSTED_PROXIES: config.get("trustedProxies") || "10.0.0.0/8",
+        CHAT_BLOB_DIR: "/var/lib/chat/blobs",
       },
       image,
+      volumeMounts: [blobs.mount("/var/lib/chat/blobs")],
       ports: { http: 8080, admin: 8081 },
       readinessProbe: {
         httpGet: { path: "/check", port: "http" },
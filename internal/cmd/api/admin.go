@@ -0,0 +1,226 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adminUserResponse is how a user is rendered to admins
+type adminUserResponse struct {
+	ID         int64      `json:"id"`
+	Username   string     `json:"username"`
+	Email      *string    `json:"email"`
+	Role       string     `json:"role"`
+	DisabledAt *time.Time `json:"disabled_at"`
+
+	// OwnerID is the user who manages this service account, or null for
+	// users who aren't service accounts
+	OwnerID *int64 `json:"owner_id"`
+}
+
+// adminUserColumns are the columns that adminUserResponse is scanned from
+const adminUserColumns = "id, username, email, role, disabled_at, owner_id"
+
+func (s *Server) listUsers() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_users_duration_seconds",
+		Help: "Histogram for listUsers endpoint latency",
+	})
+
+	type listUsersResponse struct {
+		Users []adminUserResponse `json:"users"`
+
+		// NextAfter is what to pass as after for the next page, or null once
+		// there are no more users
+		NextAfter *int64 `json:"next_after"`
+	}
+
+	const (
+		selectUsersQueryString = "SELECT " + adminUserColumns + " FROM chat_user WHERE id > $1 ORDER BY id LIMIT $2"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		after, err := int64QueryParam(r, "after", 0)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		limit, err := int64QueryParam(r, "limit", defaultPageLimit)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if limit == 0 {
+			limit = defaultPageLimit
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+
+		// Ask for one extra user to find out whether there's another page
+		rows, err := s.db.Query(r.Context(), selectUsersQueryString, after, limit+1)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		users := []adminUserResponse{}
+		for rows.Next() {
+			var user adminUserResponse
+			if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.DisabledAt, &user.OwnerID); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			users = append(users, user)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		response := listUsersResponse{Users: users}
+		if int64(len(users)) > limit {
+			response.Users = users[:limit]
+			response.NextAfter = &response.Users[limit-1].ID
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	}
+}
+
+func (s *Server) updateUser() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_update_user_duration_seconds",
+		Help: "Histogram for updateUser endpoint latency",
+	})
+
+	// Fields that are left out aren't changed
+	type updateUserRequest struct {
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+
+	const (
+		updateUserQueryString = `
+UPDATE chat_user
+	SET role = coalesce($2, role),
+		disabled_at = CASE
+				WHEN $3::boolean IS NULL THEN disabled_at
+				WHEN $3::boolean THEN coalesce(disabled_at, now())
+				ELSE NULL
+			END
+	WHERE id = $1
+	RETURNING ` + adminUserColumns
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		userID, err := int64URLParam(r, "userID")
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Parse request
+		var requestStruct updateUserRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		rules := []fieldRules{
+			// Admins locking themselves out would leave nobody to let them
+			// back in
+			field("id", userID, ensure(userID != userIDFromContext(r.Context()), "can't be your own account")),
+		}
+		if requestStruct.Role != nil {
+			rules = append(rules, field("role", *requestStruct.Role, oneOf(roleUser, roleModerator, roleAdmin)))
+		}
+		if err := validate(rules...); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		var user adminUserResponse
+		err = s.db.QueryRow(r.Context(), updateUserQueryString, userID, requestStruct.Role, requestStruct.Disabled).
+			Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.DisabledAt, &user.OwnerID)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("User not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, user)
+	}
+}
+
+func (s *Server) deleteAnyMessage() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_delete_any_message_duration_seconds",
+		Help: "Histogram for deleteAnyMessage endpoint latency",
+	})
+
+	const (
+		// Locking the message keeps an edit from writing new content after it's
+		// been scrubbed
+		selectMessageQueryString = "SELECT deleted_at IS NOT NULL FROM message WHERE id = $1 FOR UPDATE"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		messageID, err := int64URLParam(r, "messageID")
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var deleted bool
+		err = tx.QueryRow(r.Context(), selectMessageQueryString, messageID).Scan(&deleted)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if deleted {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// It's deleted for everyone the same way that a sender would, so
+		// replies keep their thread
+		if err := s.tombstoneMessage(r.Context(), tx, messageID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.logger.Info().Int64("message", messageID).Int64("by", userIDFromContext(r.Context())).Msg("Deleted message")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,373 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// apiKeyPrefix starts every API key, which is how authRequired tells them
+	// apart from access tokens. It also makes leaked keys easy to search for.
+	apiKeyPrefix = "chat_"
+
+	// scopeMessagesRead lets an API key read and stream messages
+	scopeMessagesRead = "messages:read"
+
+	// scopeMessagesWrite lets an API key send messages
+	scopeMessagesWrite = "messages:write"
+
+	// maxAPIKeyNameLength is the longest that an API key's name can be
+	maxAPIKeyNameLength = 100
+)
+
+// serviceAccountIDContextKey is where serviceAccountOwnerRequired stores the
+// ID of the service account from the URL
+const serviceAccountIDContextKey contextKey = "serviceAccountID"
+
+// serviceAccountIDFromContext returns the service account ID that was placed
+// into the request context by serviceAccountOwnerRequired
+func serviceAccountIDFromContext(ctx context.Context) int64 {
+	serviceAccountID, _ := ctx.Value(serviceAccountIDContextKey).(int64)
+	return serviceAccountID
+}
+
+// hasScopes reports whether granted includes every one of required
+func hasScopes(granted []string, required []string) bool {
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticateAPIKey looks up the ID, service account and scopes of an API
+// key. It returns a user ID of 0 if the key doesn't exist or was revoked.
+func (s *Server) authenticateAPIKey(ctx context.Context, key string) (int64, int64, []string, error) {
+	const selectAPIKeyQueryString = `
+WITH key AS (
+	SELECT id, user_id, scopes, last_used_at
+		FROM api_key
+		WHERE key_hash = $1
+			AND revoked_at IS NULL
+), used AS (
+	UPDATE api_key
+		SET last_used_at = now()
+		FROM key
+		WHERE api_key.id = key.id
+			AND (key.last_used_at IS NULL OR key.last_used_at < now() - $2::interval)
+)
+SELECT id, user_id, scopes FROM key
+`
+
+	var keyID, userID int64
+	var scopes []string
+	err := s.db.QueryRow(ctx, selectAPIKeyQueryString, hashToken(key), lastSeenResolution).Scan(&keyID, &userID, &scopes)
+	if err == pgx.ErrNoRows {
+		return 0, 0, nil, nil
+	}
+	return keyID, userID, scopes, err
+}
+
+// serviceAccountResponse describes a service account
+type serviceAccountResponse struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// apiKeyResponse describes an API key. The key itself is only ever included
+// in the response that created it.
+type apiKeyResponse struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+// serviceAccountOwnerRequired rejects requests for service accounts that the
+// caller doesn't own. Service accounts of other users are reported as not
+// found so that their existence isn't leaked.
+func (s *Server) serviceAccountOwnerRequired() func(http.Handler) http.Handler {
+	const isOwnerQueryString = "SELECT EXISTS (SELECT 1 FROM chat_user WHERE id = $1 AND owner_id = $2)"
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serviceAccountID, err := int64URLParam(r, "serviceAccountID")
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+
+			var isOwner bool
+			err = s.db.QueryRow(r.Context(), isOwnerQueryString, serviceAccountID, userIDFromContext(r.Context())).Scan(&isOwner)
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if !isOwner {
+				s.writeError(w, r, errNotFound("Service account not found"))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), serviceAccountIDContextKey, serviceAccountID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (s *Server) createServiceAccount() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_create_service_account_duration_seconds",
+		Help: "Histogram for createServiceAccount endpoint latency",
+	})
+
+	type createServiceAccountRequest struct {
+		Username string `json:"username"`
+	}
+
+	const (
+		insertQueryString = "INSERT INTO chat_user (username, password, owner_id) VALUES ($1, $2, $3) RETURNING id"
+
+		// usernameUniqueConstraint is the name postgres gave to the UNIQUE
+		// constraint on chat_user.username
+		usernameUniqueConstraint = "chat_user_username_key"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct createServiceAccountRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("username", requestStruct.Username, required, matches(usernamePattern, "must be 3 to 32 letters, digits, '_', '.' or '-'")),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Service accounts never log in, so nobody gets to know the password
+		unusablePassword, _, err := newOpaqueToken()
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		hashedPassword, err := s.hashPassword(r.Context(), unusablePassword)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		account := serviceAccountResponse{Username: requestStruct.Username}
+		err = s.db.QueryRow(r.Context(), insertQueryString, requestStruct.Username, hashedPassword, userIDFromContext(r.Context())).Scan(&account.ID)
+		if isPGError(err, pgUniqueViolation, usernameUniqueConstraint) {
+			s.writeError(w, r, errConflict("Username is already taken", err))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, account)
+	}
+}
+
+func (s *Server) listServiceAccounts() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_service_accounts_duration_seconds",
+		Help: "Histogram for listServiceAccounts endpoint latency",
+	})
+
+	type listServiceAccountsResponse struct {
+		ServiceAccounts []serviceAccountResponse `json:"service_accounts"`
+	}
+
+	const (
+		selectServiceAccountsQueryString = "SELECT id, username FROM chat_user WHERE owner_id = $1 ORDER BY id"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		rows, err := s.db.Query(r.Context(), selectServiceAccountsQueryString, userIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		accounts := []serviceAccountResponse{}
+		for rows.Next() {
+			var account serviceAccountResponse
+			if err := rows.Scan(&account.ID, &account.Username); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			accounts = append(accounts, account)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, listServiceAccountsResponse{ServiceAccounts: accounts})
+	}
+}
+
+func (s *Server) createAPIKey() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_create_api_key_duration_seconds",
+		Help: "Histogram for createAPIKey endpoint latency",
+	})
+
+	type createAPIKeyRequest struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	const (
+		insertQueryString = "INSERT INTO api_key (user_id, name, key_hash, scopes) VALUES ($1, $2, $3, $4) RETURNING id, created_at"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct createAPIKeyRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("name", requestStruct.Name, required, maxLength(maxAPIKeyNameLength)),
+			field("scopes", requestStruct.Scopes, required, eachOneOf(scopeMessagesRead, scopeMessagesWrite)),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		token, _, err := newOpaqueToken()
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		key := apiKeyPrefix + token
+
+		apiKey := apiKeyResponse{Name: requestStruct.Name, Scopes: requestStruct.Scopes, Key: key}
+		err = s.db.QueryRow(r.Context(), insertQueryString, serviceAccountIDFromContext(r.Context()), requestStruct.Name, hashToken(key), requestStruct.Scopes).Scan(&apiKey.ID, &apiKey.CreatedAt)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, apiKey)
+	}
+}
+
+func (s *Server) listAPIKeys() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_api_keys_duration_seconds",
+		Help: "Histogram for listAPIKeys endpoint latency",
+	})
+
+	type listAPIKeysResponse struct {
+		APIKeys []apiKeyResponse `json:"api_keys"`
+	}
+
+	const (
+		selectAPIKeysQueryString = "SELECT id, name, scopes, created_at, last_used_at, revoked_at FROM api_key WHERE user_id = $1 ORDER BY id"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		rows, err := s.db.Query(r.Context(), selectAPIKeysQueryString, serviceAccountIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		apiKeys := []apiKeyResponse{}
+		for rows.Next() {
+			var apiKey apiKeyResponse
+			if err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Scopes, &apiKey.CreatedAt, &apiKey.LastUsedAt, &apiKey.RevokedAt); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			apiKeys = append(apiKeys, apiKey)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, listAPIKeysResponse{APIKeys: apiKeys})
+	}
+}
+
+func (s *Server) revokeAPIKey() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_revoke_api_key_duration_seconds",
+		Help: "Histogram for revokeAPIKey endpoint latency",
+	})
+
+	const (
+		revokeQueryString = "UPDATE api_key SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		keyID, err := int64URLParam(r, "keyID")
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tag, err := s.db.Exec(r.Context(), revokeQueryString, keyID, serviceAccountIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			s.writeError(w, r, errNotFound("API key not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// isAPIKey reports whether a bearer credential is an API key rather than an
+// access token
+func isAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abatilo/chat/internal/blob"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultMaxUploadBytes is the largest upload that's accepted when the server
+// isn't configured with a limit
+const defaultMaxUploadBytes = 25 << 20
+
+// blobResponse describes an uploaded file. Its ID is what file and audio
+// messages refer to.
+type blobResponse struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+}
+
+// byteCounter counts how many bytes are written through it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+func (s *Server) maxUploadBytes() int64 {
+	if s.config.MaxUploadBytes > 0 {
+		return s.config.MaxUploadBytes
+	}
+	return defaultMaxUploadBytes
+}
+
+// uploadBlob stores the raw request body as a new blob. The Content-Type
+// header is the file's MIME type and the filename query parameter is its name.
+func (s *Server) uploadBlob() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_upload_blob_duration_seconds",
+		Help: "Histogram for uploadBlob endpoint latency",
+	})
+
+	const (
+		insertBlobQueryString = `
+INSERT INTO blob (id, uploader_id, filename, mime_type, size, checksum)
+	VALUES ($1, $2, $3, $4, $5, $6)
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+		defer r.Body.Close()
+
+		maxBytes := s.maxUploadBytes()
+		if r.ContentLength > maxBytes {
+			s.writeError(w, r, errTooLarge("File is larger than "+strconv.FormatInt(maxBytes, 10)+" bytes"))
+			return
+		}
+
+		// Normalize the casing and formatting of the MIME type before it's
+		// stored. It's empty when the header is missing or malformed.
+		filename := r.URL.Query().Get("filename")
+		mimeType := ""
+		if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+			mimeType = mime.FormatMediaType(mediaType, params)
+		}
+
+		err := validate(
+			field("filename", filename, required, maxLength(maxFilenameLength)),
+			field("Content-Type", mimeType, required),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Hash and measure the file while it streams into the store. Reading
+		// one byte past the limit tells us whether the file was too large.
+		uploaderID := userIDFromContext(r.Context())
+		blobID := uuid.New().String()
+		hash := sha256.New()
+		var size byteCounter
+		body := io.TeeReader(io.LimitReader(r.Body, maxBytes+1), io.MultiWriter(hash, &size))
+
+		if err := s.blobStore.Put(r.Context(), blobID, body); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if int64(size) > maxBytes {
+			s.deleteBlob(r, blobID)
+			s.writeError(w, r, errTooLarge("File is larger than "+strconv.FormatInt(maxBytes, 10)+" bytes"))
+			return
+		}
+
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		_, err = s.db.Exec(r.Context(), insertBlobQueryString, blobID, uploaderID, filename, mimeType, int64(size), checksum)
+		if err != nil {
+			s.deleteBlob(r, blobID)
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, blobResponse{
+			ID:       blobID,
+			Filename: filename,
+			MimeType: mimeType,
+			Size:     int64(size),
+			Checksum: checksum,
+			URL:      "/blobs/" + blobID,
+		})
+	}
+}
+
+// deleteBlob cleans up a blob whose upload failed partway through
+func (s *Server) deleteBlob(r *http.Request, blobID string) {
+	if err := s.blobStore.Delete(r.Context(), blobID); err != nil {
+		s.logger.Error().Err(err).Str("blob", blobID).Msg("Couldn't delete abandoned blob")
+	}
+}
+
+// downloadBlob streams a blob to the caller. Only the uploader and members of
+// a conversation that the blob was attached to can read it. Everyone else
+// can't tell it apart from a blob that doesn't exist.
+func (s *Server) downloadBlob() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_download_blob_duration_seconds",
+		Help: "Histogram for downloadBlob endpoint latency",
+	})
+
+	const (
+		selectReadableBlobQueryString = `
+SELECT filename, mime_type, size, checksum
+	FROM blob
+	WHERE id = $1
+		AND (
+			uploader_id = $2
+			OR EXISTS (
+				SELECT 1
+				FROM message
+					join conversation_member ON message.conversation_id = conversation_member.conversation_id
+				WHERE conversation_member.user_id = $2
+					AND message.id IN (
+						SELECT message_id FROM file_message WHERE blob_id = $1
+						UNION ALL
+						SELECT message_id FROM audio_message WHERE blob_id = $1
+					)
+			)
+		)
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		blobID, err := uuid.Parse(chi.URLParam(r, "blobID"))
+		if err != nil {
+			s.writeError(w, r, errNotFound("Blob not found"))
+			return
+		}
+
+		var filename, mimeType, checksum string
+		var size int64
+		err = s.db.QueryRow(r.Context(), selectReadableBlobQueryString, blobID.String(), userIDFromContext(r.Context())).
+			Scan(&filename, &mimeType, &size, &checksum)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Blob not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		contents, err := s.blobStore.Get(r.Context(), blobID.String())
+		if errors.Is(err, blob.ErrNotFound) {
+			s.logger.Error().Str("blob", blobID.String()).Msg("Blob is missing from the store")
+			s.writeError(w, r, errNotFound("Blob not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer contents.Close()
+
+		// Uploads are untrusted, so browsers must never render them inline
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Disposition", disposition)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", `"`+checksum+`"`)
+		w.WriteHeader(http.StatusOK)
+
+		if _, err := io.Copy(w, contents); err != nil {
+			s.logger.Info().Err(err).Str("blob", blobID.String()).Msg("Blob download was interrupted")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abatilo/chat/internal/password"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// loginFailureWindow is how long failures are remembered. A failure after
+	// a quiet period this long starts counting from scratch.
+	loginFailureWindow = time.Hour
+
+	// usernameFreeFailures is how many times a username can fail to log in
+	// before it's made to wait
+	usernameFreeFailures = 5
+
+	// ipFreeFailures is how many times an IP can fail to log in before it's
+	// made to wait. It's higher than for usernames because many users can
+	// share an IP.
+	ipFreeFailures = 20
+
+	// loginBackoffBase is how long the first lockout lasts. Every failure
+	// after that doubles it.
+	loginBackoffBase = time.Second
+
+	// maxLoginBackoff is the longest that a lockout can last
+	maxLoginBackoff = 15 * time.Minute
+
+	// emailFreeResets is how many password resets can be asked for an email
+	// before it's made to wait
+	emailFreeResets = 3
+
+	// ipFreeResets is how many password resets an IP can ask for before it's
+	// made to wait
+	ipFreeResets = 20
+)
+
+// loginAttemptKey is something that failed logins are counted against
+type loginAttemptKey struct {
+	// Scope is what kind of key this is, for metrics
+	Scope string
+
+	// Key identifies the row in login_attempt
+	Key string
+
+	// FreeFailures is how many failures are allowed before lockouts start
+	FreeFailures int
+}
+
+func loginAttemptKeys(username, ip string) []loginAttemptKey {
+	return []loginAttemptKey{
+		{Scope: "username", Key: usernameAttemptKey(username), FreeFailures: usernameFreeFailures},
+		{Scope: "ip", Key: "ip:" + ip, FreeFailures: ipFreeFailures},
+	}
+}
+
+// twoFactorAttemptKeys are what wrong two factor codes are counted against.
+// They're kept per user rather than per challenge so that getting the
+// password right again doesn't earn more guesses.
+func twoFactorAttemptKeys(userID int64, ip string) []loginAttemptKey {
+	return []loginAttemptKey{
+		{Scope: "two_factor", Key: twoFactorAttemptKey(userID), FreeFailures: maxTwoFactorAttempts},
+		{Scope: "ip", Key: "ip:" + ip, FreeFailures: ipFreeFailures},
+	}
+}
+
+// passwordResetAttemptKeys are what password reset requests are counted
+// against. Every request counts, whether or not the email has an account, so
+// that nobody can be sent an endless stream of them.
+func passwordResetAttemptKeys(email, ip string) []loginAttemptKey {
+	return []loginAttemptKey{
+		{Scope: "email", Key: "password_reset:" + strings.ToLower(email), FreeFailures: emailFreeResets},
+		{Scope: "ip", Key: "password_reset_ip:" + ip, FreeFailures: ipFreeResets},
+	}
+}
+
+func usernameAttemptKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+func twoFactorAttemptKey(userID int64) string {
+	return "two_factor:" + strconv.FormatInt(userID, 10)
+}
+
+// loginBackoff is how long to lock a key out for after its nth failure
+func loginBackoff(failures, freeFailures int) time.Duration {
+	if failures <= freeFailures {
+		return 0
+	}
+
+	backoff := loginBackoffBase
+	for i := freeFailures + 1; i < failures && backoff < maxLoginBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxLoginBackoff {
+		backoff = maxLoginBackoff
+	}
+	return backoff
+}
+
+// loginRetryAfter returns how many seconds are left on the longest lockout of
+// any of keys, or 0 if none of them are locked out
+func (s *Server) loginRetryAfter(ctx context.Context, keys []loginAttemptKey) (int, error) {
+	const selectLockoutQueryString = `
+SELECT coalesce(ceil(extract(epoch FROM max(locked_until) - now())), 0)::integer
+	FROM login_attempt
+	WHERE key = ANY($1)
+		AND locked_until > now()
+`
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.Key)
+	}
+
+	var retryAfter int
+	err := s.db.QueryRow(ctx, selectLockoutQueryString, names).Scan(&retryAfter)
+	return retryAfter, err
+}
+
+// recordLoginFailure counts a failed login against every key and locks out
+// the ones that are over their limit. It returns how many seconds are left on
+// the longest lockout, or 0 if none of them are locked out.
+func (s *Server) recordLoginFailure(ctx context.Context, keys []loginAttemptKey, lockouts *prometheus.CounterVec) (int, error) {
+	const (
+		countFailureQueryString = `
+INSERT INTO login_attempt (key, failures, last_failure_at)
+	VALUES ($1, 1, now())
+	ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_attempt.last_failure_at < now() - $2::interval THEN 1
+				ELSE login_attempt.failures + 1
+			END,
+			last_failure_at = now()
+	RETURNING failures
+`
+
+		lockQueryString = "UPDATE login_attempt SET locked_until = now() + $2::interval WHERE key = $1"
+	)
+
+	var longest time.Duration
+	for _, key := range keys {
+		var failures int
+		if err := s.db.QueryRow(ctx, countFailureQueryString, key.Key, loginFailureWindow).Scan(&failures); err != nil {
+			return 0, err
+		}
+
+		backoff := loginBackoff(failures, key.FreeFailures)
+		if backoff == 0 {
+			continue
+		}
+
+		if _, err := s.db.Exec(ctx, lockQueryString, key.Key, backoff); err != nil {
+			return 0, err
+		}
+		lockouts.WithLabelValues(key.Scope).Inc()
+		if backoff > longest {
+			longest = backoff
+		}
+	}
+
+	return int((longest + time.Second - 1) / time.Second), nil
+}
+
+// clearLoginFailures forgets the password and two factor failures of a user
+// once they've fully logged in. Failures from their IP are kept so that one
+// good account can't be used to reset the counter for guessing at others.
+func (s *Server) clearLoginFailures(ctx context.Context, userID int64, username string) error {
+	const deleteFailuresQueryString = "DELETE FROM login_attempt WHERE key = ANY($1)"
+
+	_, err := s.db.Exec(ctx, deleteFailuresQueryString, []string{usernameAttemptKey(username), twoFactorAttemptKey(userID)})
+	return err
+}
+
+// verifyCurrentPassword checks the password that a signed in user sent to
+// confirm a sensitive change. Wrong passwords count against the same keys as
+// failed logins so that a stolen access token can't be used to guess it. It
+// writes the error response and returns false unless the password matched.
+func (s *Server) verifyCurrentPassword(w http.ResponseWriter, r *http.Request, username, hashedPassword, plaintext string, lockouts *prometheus.CounterVec) bool {
+	attemptKeys := loginAttemptKeys(username, clientFromRequest(r).IP)
+	retryAfter, err := s.loginRetryAfter(r.Context(), attemptKeys)
+	if err != nil {
+		s.writeError(w, r, errInternal(err))
+		return false
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		s.writeError(w, r, errTooManyRequests("Too many wrong passwords, try again later"))
+		return false
+	}
+
+	err = s.verifyPassword(r.Context(), hashedPassword, plaintext)
+	if err == password.ErrMismatch {
+		retryAfter, err := s.recordLoginFailure(r.Context(), attemptKeys, lockouts)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Couldn't record wrong password")
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+
+		s.writeError(w, r, errForbidden("Password is incorrect"))
+		return false
+	} else if err != nil {
+		s.writeError(w, r, errInternal(err))
+		return false
+	}
+
+	return true
+}
@@ -9,12 +9,17 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/abatilo/chat/internal/blob"
+	"github.com/abatilo/chat/internal/mail"
 	"github.com/abatilo/chat/internal/metrics"
+	"github.com/abatilo/chat/internal/oidc"
+	"github.com/abatilo/chat/internal/password"
 	"github.com/alexedwards/scs/pgxstore"
 	"github.com/alexedwards/scs/v2"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
 
 	mg "github.com/golang-migrate/migrate/v4"
 
@@ -32,16 +37,40 @@ func run(logger zerolog.Logger) *cobra.Command {
 		Short: "Run the API server",
 		Run: func(cmd *cobra.Command, args []string) {
 			cfg := &ServerConfig{
-				Port:       viper.GetInt(FlagPortName),
-				AdminPort:  viper.GetInt(FlagAdminPortName),
-				PGHost:     viper.GetString(FlagPGHost),
-				PGPassword: viper.GetString(FlagPGPassword),
+				Port:                 viper.GetInt(FlagPortName),
+				AdminPort:            viper.GetInt(FlagAdminPortName),
+				PGHost:               viper.GetString(FlagPGHost),
+				PGPassword:           viper.GetString(FlagPGPassword),
+				BlobDir:              viper.GetString(FlagBlobDir),
+				MaxUploadBytes:       viper.GetInt64(FlagMaxUploadBytes),
+				AccessTokenLifetime:  viper.GetDuration(FlagAccessTokenLifetime),
+				RefreshTokenLifetime: viper.GetDuration(FlagRefreshTokenLifetime),
+				TrustedProxies:       viper.GetStringSlice(FlagTrustedProxies),
+				PasswordHash:         viper.GetString(FlagPasswordHash),
+				BcryptCost:           viper.GetInt(FlagBcryptCost),
+				Argon2Memory:         viper.GetUint32(FlagArgon2Memory),
+				Argon2Time:           viper.GetUint32(FlagArgon2Time),
+				Argon2Threads:        uint8(viper.GetUint(FlagArgon2Threads)),
+				MaxPasswordHashes:    viper.GetInt(FlagMaxPasswordHashes),
+				SMTPHost:             viper.GetString(FlagSMTPHost),
+				SMTPPort:             viper.GetInt(FlagSMTPPort),
+				SMTPUsername:         viper.GetString(FlagSMTPUsername),
+				SMTPPassword:         viper.GetString(FlagSMTPPassword),
+				MailFrom:             viper.GetString(FlagMailFrom),
+				LogMail:              viper.GetBool(FlagLogMail),
+				LogMailBodies:        viper.GetBool(FlagLogMailBodies),
+				MessageEditWindow:    viper.GetDuration(FlagMessageEditWindow),
+				OIDCIssuerURL:        viper.GetString(FlagOIDCIssuerURL),
+				OIDCClientID:         viper.GetString(FlagOIDCClientID),
+				OIDCClientSecret:     viper.GetString(FlagOIDCClientSecret),
+				OIDCRedirectURL:      viper.GetString(FlagOIDCRedirectURL),
+				OIDCScopes:           viper.GetStringSlice(FlagOIDCScopes),
 			}
-			logger.Info().Msgf("%#v", cfg)
+			logger.Info().Msgf("%#v", cfg.redacted())
 
 			// Build dependendies
 			connectionString := fmt.Sprintf("postgres://postgres:%s@%s:5432/postgres?sslmode=disable", cfg.PGPassword, cfg.PGHost)
-			logger.Info().Msg(connectionString)
+			logger.Info().Str("host", cfg.PGHost).Msg("Connecting to postgres")
 			db, err := pgxpool.Connect(context.Background(), connectionString)
 			if err != nil {
 				logger.Panic().Err(err).Msg("Unable to connect to postgres")
@@ -51,14 +80,58 @@ func run(logger zerolog.Logger) *cobra.Command {
 			sessionManager.Store = pgxstore.New(db)
 			sessionManager.Lifetime = 12 * time.Hour
 			sessionManager.IdleTimeout = 3 * time.Hour
+
+			blobStore, err := blob.NewLocalStore(cfg.BlobDir)
+			if err != nil {
+				logger.Panic().Err(err).Msg("Unable to create blob directory")
+			}
+
+			passwordHasher, err := newPasswordHasher(cfg)
+			if err != nil {
+				logger.Panic().Err(err).Msg("Unable to configure password hashing")
+			}
+
+			trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+			if err != nil {
+				logger.Panic().Err(err).Msg("Unable to parse trusted proxies")
+			}
+
+			var mailer mail.Mailer
+			switch {
+			case cfg.SMTPHost != "":
+				mailer = mail.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+			case cfg.LogMail:
+				mailer = mail.NewLogMailer(logger, cfg.LogMailBodies)
+			default:
+				logger.Warn().Msg("Password resets are turned off because no SMTP host is configured")
+			}
 			// End build dependendies
 
-			s := NewServer(cfg,
+			options := []ServerOption{
 				WithLogger(logger),
 				WithMetrics(&metrics.PrometheusMetrics{}),
 				WithDB(db),
+				WithListenerPool(db),
 				WithSessionManager(sessionManager),
-			)
+				WithBlobStore(blobStore),
+				WithPasswordHasher(passwordHasher),
+				WithTrustedProxies(trustedProxies),
+			}
+			if mailer != nil {
+				options = append(options, WithMailer(mailer))
+			}
+			if cfg.OIDCIssuerURL != "" {
+				provider := oidc.NewProvider(oidc.Config{
+					IssuerURL:    cfg.OIDCIssuerURL,
+					ClientID:     cfg.OIDCClientID,
+					ClientSecret: cfg.OIDCClientSecret,
+					RedirectURL:  cfg.OIDCRedirectURL,
+					Scopes:       cfg.OIDCScopes,
+				}, &http.Client{Timeout: 10 * time.Second})
+				options = append(options, WithOIDCProvider(provider))
+			}
+
+			s := NewServer(cfg, options...)
 
 			// Register signal handlers for graceful shutdown
 			done := make(chan struct{})
@@ -91,9 +164,103 @@ func run(logger zerolog.Logger) *cobra.Command {
 	cmd.PersistentFlags().String(FlagPGPassword, "localdev", "The password for accessing postgres")
 	viper.BindPFlag(FlagPGPassword, cmd.PersistentFlags().Lookup(FlagPGPassword))
 
+	cmd.PersistentFlags().String(FlagBlobDir, "/tmp/chat/blobs", "The directory that uploaded files are stored in")
+	viper.BindPFlag(FlagBlobDir, cmd.PersistentFlags().Lookup(FlagBlobDir))
+
+	cmd.PersistentFlags().Int64(FlagMaxUploadBytes, 25<<20, "The largest file in bytes that can be uploaded")
+	viper.BindPFlag(FlagMaxUploadBytes, cmd.PersistentFlags().Lookup(FlagMaxUploadBytes))
+
+	cmd.PersistentFlags().Duration(FlagAccessTokenLifetime, 15*time.Minute, "How long an access token stays valid")
+	viper.BindPFlag(FlagAccessTokenLifetime, cmd.PersistentFlags().Lookup(FlagAccessTokenLifetime))
+
+	cmd.PersistentFlags().Duration(FlagRefreshTokenLifetime, 30*24*time.Hour, "How long a refresh token stays valid. Every refresh extends the session by this much")
+	viper.BindPFlag(FlagRefreshTokenLifetime, cmd.PersistentFlags().Lookup(FlagRefreshTokenLifetime))
+
+	cmd.PersistentFlags().String(FlagPasswordHash, "argon2id", "The algorithm for new password hashes. Either argon2id or bcrypt")
+	viper.BindPFlag(FlagPasswordHash, cmd.PersistentFlags().Lookup(FlagPasswordHash))
+
+	cmd.PersistentFlags().Int(FlagBcryptCost, bcrypt.DefaultCost, "The cost of new bcrypt password hashes")
+	viper.BindPFlag(FlagBcryptCost, cmd.PersistentFlags().Lookup(FlagBcryptCost))
+
+	cmd.PersistentFlags().Uint32(FlagArgon2Memory, password.DefaultArgon2id().Memory, "How much memory new argon2id password hashes use, in KiB")
+	viper.BindPFlag(FlagArgon2Memory, cmd.PersistentFlags().Lookup(FlagArgon2Memory))
+
+	cmd.PersistentFlags().Uint32(FlagArgon2Time, password.DefaultArgon2id().Time, "How many passes new argon2id password hashes make")
+	viper.BindPFlag(FlagArgon2Time, cmd.PersistentFlags().Lookup(FlagArgon2Time))
+
+	cmd.PersistentFlags().Uint8(FlagArgon2Threads, password.DefaultArgon2id().Threads, "The parallelism of new argon2id password hashes")
+	viper.BindPFlag(FlagArgon2Threads, cmd.PersistentFlags().Lookup(FlagArgon2Threads))
+
+	cmd.PersistentFlags().Int(FlagMaxPasswordHashes, defaultMaxPasswordHashes, "How many passwords can be hashed or verified at once. Each argon2id one takes argon2-memory, so this times that is their memory budget")
+	viper.BindPFlag(FlagMaxPasswordHashes, cmd.PersistentFlags().Lookup(FlagMaxPasswordHashes))
+
+	cmd.PersistentFlags().StringSlice(FlagTrustedProxies, []string{}, "The CIDRs of the reverse proxies in front of the server. The client IP is the right-most X-Forwarded-For hop that isn't one of them")
+	viper.BindPFlag(FlagTrustedProxies, cmd.PersistentFlags().Lookup(FlagTrustedProxies))
+
+	cmd.PersistentFlags().String(FlagSMTPHost, "", "The SMTP server to send email through. Password resets are turned off when this is empty, unless log-mail is set")
+	viper.BindPFlag(FlagSMTPHost, cmd.PersistentFlags().Lookup(FlagSMTPHost))
+
+	cmd.PersistentFlags().Bool(FlagLogMail, false, "Log email instead of sending it when there's no SMTP host. Only for local development")
+	viper.BindPFlag(FlagLogMail, cmd.PersistentFlags().Lookup(FlagLogMail))
+
+	cmd.PersistentFlags().Bool(FlagLogMailBodies, false, "Include the body when email is logged, password reset tokens and all. Only for local development")
+	viper.BindPFlag(FlagLogMailBodies, cmd.PersistentFlags().Lookup(FlagLogMailBodies))
+
+	cmd.PersistentFlags().Int(FlagSMTPPort, 587, "The port of the SMTP server")
+	viper.BindPFlag(FlagSMTPPort, cmd.PersistentFlags().Lookup(FlagSMTPPort))
+
+	cmd.PersistentFlags().String(FlagSMTPUsername, "", "The username for the SMTP server")
+	viper.BindPFlag(FlagSMTPUsername, cmd.PersistentFlags().Lookup(FlagSMTPUsername))
+
+	cmd.PersistentFlags().String(FlagSMTPPassword, "", "The password for the SMTP server")
+	viper.BindPFlag(FlagSMTPPassword, cmd.PersistentFlags().Lookup(FlagSMTPPassword))
+
+	cmd.PersistentFlags().String(FlagMailFrom, "chat@localhost", "The address that email is sent from")
+	viper.BindPFlag(FlagMailFrom, cmd.PersistentFlags().Lookup(FlagMailFrom))
+
+	cmd.PersistentFlags().Duration(FlagMessageEditWindow, 15*time.Minute, "How long after sending a text message its sender can still edit it")
+	viper.BindPFlag(FlagMessageEditWindow, cmd.PersistentFlags().Lookup(FlagMessageEditWindow))
+
+	cmd.PersistentFlags().String(FlagOIDCIssuerURL, "", "The OpenID Connect provider that users can sign in with. Signing in with a provider is turned off when this is empty")
+	viper.BindPFlag(FlagOIDCIssuerURL, cmd.PersistentFlags().Lookup(FlagOIDCIssuerURL))
+
+	cmd.PersistentFlags().String(FlagOIDCClientID, "chat", "The client ID registered with the OpenID Connect provider")
+	viper.BindPFlag(FlagOIDCClientID, cmd.PersistentFlags().Lookup(FlagOIDCClientID))
+
+	cmd.PersistentFlags().String(FlagOIDCClientSecret, "", "The client secret registered with the OpenID Connect provider. Leave it empty for a public client")
+	viper.BindPFlag(FlagOIDCClientSecret, cmd.PersistentFlags().Lookup(FlagOIDCClientSecret))
+
+	cmd.PersistentFlags().String(FlagOIDCRedirectURL, "http://localhost:8080/auth/oidc/callback", "The public URL of the OpenID Connect callback")
+	viper.BindPFlag(FlagOIDCRedirectURL, cmd.PersistentFlags().Lookup(FlagOIDCRedirectURL))
+
+	cmd.PersistentFlags().StringSlice(FlagOIDCScopes, []string{"profile", "email"}, "The scopes requested from the OpenID Connect provider, on top of openid")
+	viper.BindPFlag(FlagOIDCScopes, cmd.PersistentFlags().Lookup(FlagOIDCScopes))
+
 	return cmd
 }
 
+// newPasswordHasher builds the password hashing policy that cfg asks for
+func newPasswordHasher(cfg *ServerConfig) (password.Hasher, error) {
+	switch cfg.PasswordHash {
+	case "argon2id":
+		hasher := password.DefaultArgon2id()
+		hasher.Memory = cfg.Argon2Memory
+		hasher.Time = cfg.Argon2Time
+		hasher.Threads = cfg.Argon2Threads
+		if hasher.Memory == 0 || hasher.Time == 0 || hasher.Threads == 0 {
+			return nil, fmt.Errorf("argon2id memory, time and threads must all be positive")
+		}
+		return hasher, nil
+	case "bcrypt":
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return password.Bcrypt{Cost: cfg.BcryptCost}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", cfg.PasswordHash)
+	}
+}
+
 func migrate(logger zerolog.Logger) *cobra.Command {
 	return &cobra.Command{
 		Use:       "migrate (up|down)",
@@ -0,0 +1,449 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ContentType is a kind of message content, like text or images. Each content
+// type owns a table keyed on message_id and knows how to validate, write and
+// render its own content. Adding a new kind of message only requires a
+// migration for that table and a new ContentType in the registry.
+type ContentType interface {
+	// Name identifies the content type in requests, responses and the
+	// message_type table
+	Name() string
+
+	// New returns an empty Content that the request's content JSON is
+	// unmarshalled into
+	New() Content
+
+	// Table is the table that holds this content type's rows, keyed on
+	// message_id
+	Table() string
+
+	// Join is the SQL join clause that brings this content type's table into
+	// a query over message. It must be a LEFT JOIN because every message only
+	// has a row in a single content table.
+	Join() string
+
+	// Projection is the SQL expression that renders a message of this type
+	// as a JSON object, using the tables from Join
+	Projection() string
+}
+
+// Content is the parsed content of a single message
+type Content interface {
+	// Rules fills in any defaults and declares how the content is validated.
+	// Field names are prefixed with prefix.
+	Rules(prefix string) []fieldRules
+
+	// Insert writes the content for messageID within tx
+	Insert(ctx context.Context, tx pgx.Tx, messageID int64) error
+}
+
+// replyPreviewLength is how many characters of a text message are shown in
+// the preview of a reply's parent
+const replyPreviewLength = 100
+
+// ContentRegistry is the set of content types that messages can have
+type ContentRegistry struct {
+	types  []ContentType
+	byName map[string]ContentType
+
+	// selectBody is the part of the query for rendering messages that comes
+	// after the desired_messages CTE. It's built once from every registered
+	// content type.
+	selectBody string
+}
+
+// NewContentRegistry creates a registry of the given content types
+func NewContentRegistry(types ...ContentType) *ContentRegistry {
+	registry := &ContentRegistry{
+		types:  types,
+		byName: map[string]ContentType{},
+	}
+
+	var projections, joins strings.Builder
+	for _, contentType := range types {
+		registry.byName[contentType.Name()] = contentType
+		fmt.Fprintf(&projections, "\n\t\t\t\t\tWHEN '%s' THEN %s", contentType.Name(), contentType.Projection())
+		fmt.Fprintf(&joins, "\n\t\t%s", contentType.Join())
+	}
+
+	registry.selectBody = `
+SELECT message.id,
+			 message.conversation_id,
+			 message.sender_id,
+			 coalesce(message.recipient_id, 0),
+			 message.created_at,
+			 message.edited_at,
+			 message.deleted_at,
+			 CASE
+				WHEN message.deleted_at IS NOT NULL THEN json_build_object('type', 'deleted')
+				ELSE CASE message_type.name` + projections.String() + `
+					ELSE json_build_object('type', message_type.name)
+				END
+			 END AS content,
+			 CASE WHEN parent.id IS NOT NULL THEN
+				json_build_object(
+					'id', parent.id,
+					'sender', parent.sender_id,
+					'type', CASE WHEN parent.deleted_at IS NOT NULL THEN 'deleted' ELSE parent_type.name END,
+					'text', CASE WHEN parent.deleted_at IS NULL THEN left(parent_text.text, ` + fmt.Sprint(replyPreviewLength) + `) END
+				)
+			 END AS reply_to,
+			 message.root_id,
+			 message.reply_count
+	FROM message
+		join desired_messages ON message.id = desired_messages.message_id
+		join message_type ON message.message_type_id = message_type.id` + joins.String() + `
+		left join message AS parent ON parent.id = message.reply_to_id
+		left join message_type AS parent_type ON parent.message_type_id = parent_type.id
+		left join text_message AS parent_text ON parent.id = parent_text.message_id
+ORDER BY message.id
+`
+
+	return registry
+}
+
+// DefaultContentTypes returns a registry of every content type that ships
+// with the API server
+func DefaultContentTypes() *ContentRegistry {
+	return NewContentRegistry(
+		textContentType{},
+		imageContentType{},
+		videoContentType{},
+		fileContentType{},
+		audioContentType{},
+	)
+}
+
+// Names returns the name of every registered content type
+func (c *ContentRegistry) Names() []string {
+	names := make([]string, 0, len(c.types))
+	for _, contentType := range c.types {
+		names = append(names, contentType.Name())
+	}
+	return names
+}
+
+// Lookup returns the content type with the given name
+func (c *ContentRegistry) Lookup(name string) (ContentType, bool) {
+	contentType, ok := c.byName[name]
+	return contentType, ok
+}
+
+// selectMessagesQuery shapes messages into their response form.
+// desiredMessagesQuery must select the IDs of the desired messages as
+// message_id. Every desired message produces exactly one row, so a LIMIT in
+// that query controls exactly how many messages come back.
+func (c *ContentRegistry) selectMessagesQuery(desiredMessagesQuery string) string {
+	return "WITH desired_messages AS (" + desiredMessagesQuery + ")" + c.selectBody
+}
+
+// register makes sure that every content type has a row in message_type
+func (c *ContentRegistry) register(ctx context.Context, db PGDB) error {
+	const insertMessageTypeQueryString = "INSERT INTO message_type (name) VALUES ($1) ON CONFLICT (name) DO NOTHING"
+
+	for _, contentType := range c.types {
+		if _, err := db.Exec(ctx, insertMessageTypeQueryString, contentType.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteContent removes the content of messageID from every content type's
+// table so that nothing of a message that was deleted for everyone is kept
+func (c *ContentRegistry) deleteContent(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	for _, contentType := range c.types {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+contentType.Table()+" WHERE message_id = $1", messageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseContent resolves raw content JSON to its content type and declares how
+// it's validated. The returned Content is nil when the type isn't registered,
+// in which case the rules report it.
+func (c *ContentRegistry) parseContent(prefix string, raw json.RawMessage) (ContentType, Content, []fieldRules, error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, nil, nil, errBadRequest("Content is not a valid JSON object", err)
+		}
+	}
+
+	typeRules := field(prefix+"type", header.Type, required, oneOf(c.Names()...))
+	contentType, ok := c.Lookup(header.Type)
+	if !ok {
+		return nil, nil, []fieldRules{typeRules}, nil
+	}
+
+	content := contentType.New()
+	if err := json.Unmarshal(raw, content); err != nil {
+		return nil, nil, nil, errBadRequest("Content doesn't match its type", err)
+	}
+
+	return contentType, content, append([]fieldRules{typeRules}, content.Rules(prefix)...), nil
+}
+
+type textContentType struct{}
+
+func (textContentType) Name() string { return "text" }
+
+func (textContentType) New() Content { return &textContent{} }
+
+func (textContentType) Table() string { return "text_message" }
+
+func (textContentType) Join() string {
+	return "left join text_message ON message.id = text_message.message_id"
+}
+
+func (textContentType) Projection() string {
+	return `json_build_object(
+					'type', message_type.name,
+					'text', text_message.text
+				)`
+}
+
+type textContent struct {
+	Text string `json:"text"`
+}
+
+func (t *textContent) Rules(prefix string) []fieldRules {
+	return []fieldRules{
+		field(prefix+"text", t.Text, required, maxLength(maxTextLength)),
+	}
+}
+
+func (t *textContent) Insert(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	const createTextMessageQueryString = "INSERT INTO text_message (message_id, text) VALUES ($1, $2)"
+
+	_, err := tx.Exec(ctx, createTextMessageQueryString, messageID, t.Text)
+	return err
+}
+
+type imageContentType struct{}
+
+func (imageContentType) Name() string { return "image" }
+
+func (imageContentType) New() Content { return &imageContent{} }
+
+func (imageContentType) Table() string { return "image_message" }
+
+func (imageContentType) Join() string {
+	return "left join image_message ON message.id = image_message.message_id"
+}
+
+func (imageContentType) Projection() string {
+	return `json_build_object(
+					'type',     message_type.name,
+					'url',      image_message.url,
+					'width',    image_message.width,
+					'height',   image_message.height
+				)`
+}
+
+type imageContent struct {
+	URL    string `json:"url"`
+	Height uint64 `json:"height"`
+	Width  uint64 `json:"width"`
+}
+
+func (i *imageContent) Rules(prefix string) []fieldRules {
+	if i.Width == 0 {
+		i.Width = 64
+	}
+	if i.Height == 0 {
+		i.Height = 64
+	}
+
+	return []fieldRules{
+		field(prefix+"url", i.URL, required, absoluteURL),
+		field(prefix+"width", i.Width, between(1, maxImageDimension)),
+		field(prefix+"height", i.Height, between(1, maxImageDimension)),
+	}
+}
+
+func (i *imageContent) Insert(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	const createImageMessageQueryString = "INSERT INTO image_message (message_id, url, width, height) VALUES ($1, $2, $3, $4)"
+
+	_, err := tx.Exec(ctx, createImageMessageQueryString, messageID, i.URL, i.Width, i.Height)
+	return err
+}
+
+type videoContentType struct{}
+
+func (videoContentType) Name() string { return "video" }
+
+func (videoContentType) New() Content { return &videoContent{} }
+
+func (videoContentType) Table() string { return "video_message" }
+
+func (videoContentType) Join() string {
+	return "left join video_message ON message.id = video_message.message_id"
+}
+
+func (videoContentType) Projection() string {
+	return `json_build_object(
+					'type',     message_type.name,
+					'url',      video_message.url,
+					'source',   video_message.source
+				)`
+}
+
+type videoContent struct {
+	URL    string `json:"url"`
+	Source string `json:"source"`
+}
+
+func (v *videoContent) Rules(prefix string) []fieldRules {
+	return []fieldRules{
+		field(prefix+"url", v.URL, required, absoluteURL),
+		field(prefix+"source", v.Source, required),
+	}
+}
+
+func (v *videoContent) Insert(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	const createVideoMessageQueryString = `
+INSERT INTO video_message (message_id, url, source)
+	SELECT $1, $2, video_source.id
+	FROM video_source
+	WHERE video_source.name = $3
+`
+
+	tag, err := tx.Exec(ctx, createVideoMessageQueryString, messageID, v.URL, v.Source)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		// The INSERT ... SELECT doesn't insert anything when the source doesn't exist
+		return errUnprocessable("Unknown video source", map[string]string{"source": v.Source})
+	}
+	return nil
+}
+
+// blobProjection renders the blob that a file or audio message is attached to
+func blobProjection(table string) string {
+	return `'blob',      ` + table + `.id,
+						'filename',  ` + table + `.filename,
+						'mime_type', ` + table + `.mime_type,
+						'size',      ` + table + `.size,
+						'checksum',  ` + table + `.checksum,
+						'url',       '/blobs/' || ` + table + `.id`
+}
+
+type fileContentType struct{}
+
+func (fileContentType) Name() string { return "file" }
+
+func (fileContentType) New() Content { return &fileContent{} }
+
+func (fileContentType) Table() string { return "file_message" }
+
+func (fileContentType) Join() string {
+	return `left join file_message ON message.id = file_message.message_id
+		left join blob AS file_blob ON file_message.blob_id = file_blob.id`
+}
+
+func (fileContentType) Projection() string {
+	return `json_build_object(
+						'type',      message_type.name,
+						` + blobProjection("file_blob") + `
+					)`
+}
+
+type fileContent struct {
+	Blob string `json:"blob"`
+}
+
+func (f *fileContent) Rules(prefix string) []fieldRules {
+	return []fieldRules{
+		field(prefix+"blob", f.Blob, required, uuidString),
+	}
+}
+
+func (f *fileContent) Insert(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	// Only the uploader can attach a blob to a message
+	const createFileMessageQueryString = `
+INSERT INTO file_message (message_id, blob_id)
+	SELECT message.id, blob.id
+	FROM message
+		join blob ON blob.uploader_id = message.sender_id
+	WHERE message.id = $1
+		AND blob.id = $2
+`
+
+	tag, err := tx.Exec(ctx, createFileMessageQueryString, messageID, f.Blob)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUnprocessable("Unknown blob", map[string]string{"blob": f.Blob})
+	}
+	return nil
+}
+
+type audioContentType struct{}
+
+func (audioContentType) Name() string { return "audio" }
+
+func (audioContentType) New() Content { return &audioContent{} }
+
+func (audioContentType) Table() string { return "audio_message" }
+
+func (audioContentType) Join() string {
+	return `left join audio_message ON message.id = audio_message.message_id
+		left join blob AS audio_blob ON audio_message.blob_id = audio_blob.id`
+}
+
+func (audioContentType) Projection() string {
+	return `json_build_object(
+						'type',        message_type.name,
+						` + blobProjection("audio_blob") + `,
+						'duration_ms', audio_message.duration_ms
+					)`
+}
+
+type audioContent struct {
+	Blob       string `json:"blob"`
+	DurationMS uint64 `json:"duration_ms"`
+}
+
+func (a *audioContent) Rules(prefix string) []fieldRules {
+	return []fieldRules{
+		field(prefix+"blob", a.Blob, required, uuidString),
+		field(prefix+"duration_ms", a.DurationMS, required, between(1, maxAudioDurationMS)),
+	}
+}
+
+func (a *audioContent) Insert(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	// Only the uploader can attach a blob to a message, and it has to be audio
+	const createAudioMessageQueryString = `
+INSERT INTO audio_message (message_id, blob_id, duration_ms)
+	SELECT message.id, blob.id, $3::integer
+	FROM message
+		join blob ON blob.uploader_id = message.sender_id
+	WHERE message.id = $1
+		AND blob.id = $2
+		AND blob.mime_type LIKE 'audio/%'
+`
+
+	tag, err := tx.Exec(ctx, createAudioMessageQueryString, messageID, a.Blob, a.DurationMS)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUnprocessable("Unknown audio blob", map[string]string{"blob": a.Blob})
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxConversationNameLength is the most characters a conversation name may have
+	maxConversationNameLength = 100
+
+	// maxConversationMembers is the most members that can be added at once
+	maxConversationMembers = 256
+)
+
+// conversationIDContextKey is where conversationMemberRequired stores the ID
+// of the conversation from the URL
+const conversationIDContextKey contextKey = "conversationID"
+
+// conversationIDFromContext returns the conversation ID that was placed into
+// the request context by conversationMemberRequired
+func conversationIDFromContext(ctx context.Context) int64 {
+	conversationID, _ := ctx.Value(conversationIDContextKey).(int64)
+	return conversationID
+}
+
+// conversationResponse is how a single conversation is rendered to clients
+type conversationResponse struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Direct    bool      `json:"direct"`
+	Members   []int64   `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastMessage is a preview of the most recent message, if there is one
+	LastMessage *messageResponse `json:"last_message"`
+}
+
+// directConversation returns the ID of the implicit conversation between two
+// users, creating it if this is the first time they've talked
+func directConversation(ctx context.Context, tx pgx.Tx, userID int64, otherUserID int64) (int64, error) {
+	const (
+		upsertDirectConversationQueryString = `
+INSERT INTO conversation (direct_key, created_by)
+	VALUES ($1, $2)
+	ON CONFLICT (direct_key) DO UPDATE SET direct_key = EXCLUDED.direct_key
+	RETURNING id
+`
+		insertDirectMembersQueryString = `
+INSERT INTO conversation_member (conversation_id, user_id)
+	VALUES ($1, $2), ($1, $3)
+	ON CONFLICT DO NOTHING
+`
+	)
+
+	low, high := userID, otherUserID
+	if low > high {
+		low, high = high, low
+	}
+
+	var conversationID int64
+	err := tx.QueryRow(ctx, upsertDirectConversationQueryString, fmt.Sprintf("%d:%d", low, high), userID).Scan(&conversationID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, insertDirectMembersQueryString, conversationID, low, high)
+	return conversationID, err
+}
+
+// conversationMemberRequired rejects requests for conversations that the
+// caller isn't a member of. Conversations that the caller can't see are
+// reported as not found so that their existence isn't leaked.
+func (s *Server) conversationMemberRequired() func(http.Handler) http.Handler {
+	const isMemberQueryString = "SELECT EXISTS (SELECT 1 FROM conversation_member WHERE conversation_id = $1 AND user_id = $2)"
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conversationID, err := int64URLParam(r, "conversationID")
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+
+			var isMember bool
+			err = s.db.QueryRow(r.Context(), isMemberQueryString, conversationID, userIDFromContext(r.Context())).Scan(&isMember)
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if !isMember {
+				s.writeError(w, r, errNotFound("Conversation not found"))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), conversationIDContextKey, conversationID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (s *Server) createConversation() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_create_conversation_duration_seconds",
+		Help: "Histogram for createConversation endpoint latency",
+	})
+
+	type createConversationRequest struct {
+		Name    string  `json:"name"`
+		Members []int64 `json:"members"`
+	}
+
+	const (
+		insertConversationQueryString = "INSERT INTO conversation (name, created_by) VALUES ($1, $2) RETURNING id, created_at"
+		insertMembersQueryString      = `
+INSERT INTO conversation_member (conversation_id, user_id)
+	SELECT $1, unnest($2::bigint[])
+	ON CONFLICT DO NOTHING
+`
+		selectMembersQueryString = "SELECT array_agg(user_id ORDER BY user_id) FROM conversation_member WHERE conversation_id = $1"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		var requestStruct createConversationRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		membersExist, err := s.usersExist(r.Context(), requestStruct.Members)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		err = validate(
+			field("name", requestStruct.Name, required, maxLength(maxConversationNameLength)),
+			field("members", requestStruct.Members, required, maxItems(maxConversationMembers), ensure(membersExist, "must all be existing users")),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		conversation := conversationResponse{Name: requestStruct.Name}
+		err = tx.QueryRow(r.Context(), insertConversationQueryString, requestStruct.Name, userID).Scan(&conversation.ID, &conversation.CreatedAt)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// The creator is always a member
+		members := append([]int64{userID}, requestStruct.Members...)
+		if _, err := tx.Exec(r.Context(), insertMembersQueryString, conversation.ID, members); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.QueryRow(r.Context(), selectMembersQueryString, conversation.ID).Scan(&conversation.Members); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, conversation)
+	}
+}
+
+func (s *Server) listConversations() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_conversations_duration_seconds",
+		Help: "Histogram for listConversations endpoint latency",
+	})
+
+	type listConversationsResponse struct {
+		Conversations []conversationResponse `json:"conversations"`
+	}
+
+	const (
+		listConversationsQueryString = `
+SELECT conversation.id,
+			 coalesce(conversation.name, ''),
+			 conversation.direct_key IS NOT NULL,
+			 conversation.created_at,
+			 (SELECT array_agg(members.user_id ORDER BY members.user_id)
+					FROM conversation_member AS members
+					WHERE members.conversation_id = conversation.id),
+			 (SELECT max(message.id)
+					FROM message
+					WHERE message.conversation_id = conversation.id
+						AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $1))
+	FROM conversation
+		join conversation_member ON conversation.id = conversation_member.conversation_id
+	WHERE conversation_member.user_id = $1
+	ORDER BY 6 DESC NULLS LAST, conversation.id DESC
+`
+		lastMessagesQueryString = "SELECT unnest($1::bigint[]) AS message_id"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		rows, err := s.db.Query(r.Context(), listConversationsQueryString, userIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		conversations := []conversationResponse{}
+		var lastMessageIDs []int64
+		for rows.Next() {
+			var c conversationResponse
+			var lastMessageID *int64
+			if err := rows.Scan(&c.ID, &c.Name, &c.Direct, &c.CreatedAt, &c.Members, &lastMessageID); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if lastMessageID != nil {
+				lastMessageIDs = append(lastMessageIDs, *lastMessageID)
+			}
+			conversations = append(conversations, c)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if len(lastMessageIDs) > 0 {
+			lastMessages, err := s.queryMessages(r.Context(), s.db, lastMessagesQueryString, lastMessageIDs)
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+
+			byConversation := map[int64]*messageResponse{}
+			for i := range lastMessages {
+				byConversation[lastMessages[i].Conversation] = &lastMessages[i]
+			}
+			for i := range conversations {
+				conversations[i].LastMessage = byConversation[conversations[i].ID]
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, listConversationsResponse{
+			Conversations: conversations,
+		})
+	}
+}
+
+// isDirectConversation reports whether a conversation is an implicit
+// conversation between two users, whose membership can't change
+func (s *Server) isDirectConversation(ctx context.Context, conversationID int64) (bool, error) {
+	const isDirectQueryString = "SELECT direct_key IS NOT NULL FROM conversation WHERE id = $1"
+
+	var isDirect bool
+	err := s.db.QueryRow(ctx, isDirectQueryString, conversationID).Scan(&isDirect)
+	return isDirect, err
+}
+
+func (s *Server) addConversationMember() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_add_conversation_member_duration_seconds",
+		Help: "Histogram for addConversationMember endpoint latency",
+	})
+
+	type addConversationMemberRequest struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	const (
+		// New members start out having read everything that was sent before
+		// they joined
+		insertMemberQueryString = `
+INSERT INTO conversation_member (conversation_id, user_id, last_read_id)
+	SELECT $1, $2, coalesce(max(id), 0)
+		FROM message
+		WHERE conversation_id = $1
+	ON CONFLICT DO NOTHING
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		var requestStruct addConversationMemberRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userExists, err := s.userExists(r.Context(), requestStruct.UserID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if err := validate(field("user_id", requestStruct.UserID, required, ensure(userExists, "does not exist"))); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		conversationID := conversationIDFromContext(r.Context())
+		isDirect, err := s.isDirectConversation(r.Context(), conversationID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if isDirect {
+			s.writeError(w, r, errUnprocessable("Members can't be added to a direct conversation", nil))
+			return
+		}
+
+		if _, err := s.db.Exec(r.Context(), insertMemberQueryString, conversationID, requestStruct.UserID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) removeConversationMember() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_remove_conversation_member_duration_seconds",
+		Help: "Histogram for removeConversationMember endpoint latency",
+	})
+
+	const (
+		selectCreatorQueryString = "SELECT coalesce(created_by, 0) FROM conversation WHERE id = $1"
+		deleteMemberQueryString  = "DELETE FROM conversation_member WHERE conversation_id = $1 AND user_id = $2"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		memberID, err := int64URLParam(r, "userID")
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		conversationID := conversationIDFromContext(r.Context())
+		isDirect, err := s.isDirectConversation(r.Context(), conversationID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if isDirect {
+			s.writeError(w, r, errUnprocessable("Members can't be removed from a direct conversation", nil))
+			return
+		}
+
+		// Anybody can leave, but only the creator can remove somebody else
+		userID := userIDFromContext(r.Context())
+		if memberID != userID {
+			var creatorID int64
+			if err := s.db.QueryRow(r.Context(), selectCreatorQueryString, conversationID).Scan(&creatorID); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if creatorID != userID {
+				s.writeError(w, r, errForbidden("Only the creator of a conversation can remove other members"))
+				return
+			}
+		}
+
+		tag, err := s.db.Exec(r.Context(), deleteMemberQueryString, conversationID, memberID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			s.writeError(w, r, errNotFound("Member not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) createConversationMessage() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_create_conversation_message_duration_seconds",
+		Help: "Histogram for createConversationMessage endpoint latency",
+	})
+
+	type createConversationMessageRequest struct {
+		Content json.RawMessage `json:"content"`
+		// ReplyTo is the message that this one replies to, if any
+		ReplyTo *int64 `json:"reply_to"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		var requestStruct createConversationMessageRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		contentType, content, contentRules, err := s.contentTypes.parseContent("content.", requestStruct.Content)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if err := validate(contentRules...); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		messageID, createdAt, err := insertMessage(r.Context(), tx, newMessage{
+			SenderID:       userIDFromContext(r.Context()),
+			ConversationID: conversationIDFromContext(r.Context()),
+			ContentType:    contentType,
+			Content:        content,
+			ReplyToID:      requestStruct.ReplyTo,
+		})
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, createMessageResponse{
+			ID:        messageID,
+			Timestamp: createdAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+func (s *Server) listConversationMessages() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_conversation_messages_duration_seconds",
+		Help: "Histogram for listConversationMessages endpoint latency",
+	})
+
+	const (
+		listConversationMessagesFilter = "conversation_id = $4"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		page, err := parseMessagePageRequest(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		conversationID := conversationIDFromContext(r.Context())
+		messages, err := s.pageMessages(r.Context(), userIDFromContext(r.Context()), listConversationMessagesFilter, []interface{}{conversationID}, page)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, messages)
+	}
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// deleteForMe hides a message from the caller while everyone else still
+	// sees it
+	deleteForMe = "me"
+
+	// deleteForEveryone replaces the message with a tombstone for every member
+	// of the conversation
+	deleteForEveryone = "everyone"
+)
+
+// tombstoneMessage deletes messageID for everyone. Nothing that the message
+// said is kept, including earlier versions, and there's nothing left to react
+// to. The row stays behind so that replies to it still have a thread.
+func (s *Server) tombstoneMessage(ctx context.Context, tx pgx.Tx, messageID int64) error {
+	const (
+		deleteRevisionsQueryString = "DELETE FROM message_revision WHERE message_id = $1"
+
+		deleteReactionsQueryString = "DELETE FROM message_reaction WHERE message_id = $1"
+
+		tombstoneMessageQueryString = "UPDATE message SET deleted_at = now() WHERE id = $1"
+	)
+
+	if err := s.contentTypes.deleteContent(ctx, tx, messageID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, deleteRevisionsQueryString, messageID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, deleteReactionsQueryString, messageID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, tombstoneMessageQueryString, messageID)
+	return err
+}
+
+func (s *Server) deleteMessage() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_delete_message_duration_seconds",
+		Help: "Histogram for deleteMessage endpoint latency",
+	})
+
+	const (
+		hideMessageQueryString = "INSERT INTO message_hide (message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+
+		// Locking the message keeps an edit from writing new content after it's
+		// been scrubbed
+		selectMessageQueryString = "SELECT sender_id, deleted_at IS NOT NULL FROM message WHERE id = $1 FOR UPDATE"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		mode := r.URL.Query().Get("for")
+		if mode == "" {
+			mode = deleteForMe
+		}
+		err := validate(
+			field("for", mode, oneOf(deleteForMe, deleteForEveryone)),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		messageID := messageIDFromContext(r.Context())
+		userID := userIDFromContext(r.Context())
+
+		if mode == deleteForMe {
+			if _, err := s.db.Exec(r.Context(), hideMessageQueryString, messageID, userID); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var senderID int64
+		var deleted bool
+		err = tx.QueryRow(r.Context(), selectMessageQueryString, messageID).Scan(&senderID, &deleted)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if senderID != userID {
+			s.writeError(w, r, errForbidden("Only the sender can delete a message for everyone"))
+			return
+		}
+		if deleted {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := s.tombstoneMessage(r.Context(), tx, messageID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultMessageEditWindow is how long a message can be edited for when the
+// server isn't configured with a window
+const defaultMessageEditWindow = 15 * time.Minute
+
+func (s *Server) messageEditWindow() time.Duration {
+	if s.config.MessageEditWindow > 0 {
+		return s.config.MessageEditWindow
+	}
+	return defaultMessageEditWindow
+}
+
+// messageRevisionResponse is one version of a message's text
+type messageRevisionResponse struct {
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Current is whether this is the version that's shown now
+	Current bool `json:"current"`
+}
+
+func (s *Server) editMessage() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_edit_message_duration_seconds",
+		Help: "Histogram for editMessage endpoint latency",
+	})
+
+	type editMessageRequest struct {
+		Text string `json:"text"`
+	}
+
+	const (
+		// Locking the message makes concurrent edits take turns so that no
+		// revision is lost
+		selectMessageQueryString = `
+SELECT message.sender_id, message.created_at, message.deleted_at IS NOT NULL, message_type.name
+	FROM message
+		join message_type ON message.message_type_id = message_type.id
+	WHERE message.id = $1
+	FOR UPDATE OF message
+`
+
+		insertRevisionQueryString = `
+INSERT INTO message_revision (message_id, text, created_at)
+	SELECT message.id, text_message.text, coalesce(message.edited_at, message.created_at)
+		FROM message
+			join text_message ON message.id = text_message.message_id
+		WHERE message.id = $1
+`
+
+		updateTextQueryString = "UPDATE text_message SET text = $2 WHERE message_id = $1"
+
+		updateEditedAtQueryString = "UPDATE message SET edited_at = now() WHERE id = $1"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct editMessageRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("text", requestStruct.Text, required, maxLength(maxTextLength)),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		messageID := messageIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var senderID int64
+		var createdAt time.Time
+		var deleted bool
+		var messageType string
+		err = tx.QueryRow(r.Context(), selectMessageQueryString, messageID).Scan(&senderID, &createdAt, &deleted, &messageType)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if senderID != userIDFromContext(r.Context()) {
+			s.writeError(w, r, errForbidden("Only the sender can edit a message"))
+			return
+		}
+		if time.Since(createdAt) > s.messageEditWindow() {
+			s.writeError(w, r, errForbidden("Messages can only be edited for "+s.messageEditWindow().String()+" after they're sent"))
+			return
+		}
+		if deleted {
+			s.writeError(w, r, errConflict("Deleted messages can't be edited", nil))
+			return
+		}
+		if messageType != (textContentType{}).Name() {
+			s.writeError(w, r, errUnprocessable("Only text messages can be edited", map[string]string{"type": messageType}))
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), insertRevisionQueryString, messageID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if _, err := tx.Exec(r.Context(), updateTextQueryString, messageID, requestStruct.Text); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if _, err := tx.Exec(r.Context(), updateEditedAtQueryString, messageID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		messages, err := s.queryMessages(r.Context(), tx, messageByIDQueryString, messageID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, messages[0])
+	}
+}
+
+func (s *Server) listMessageRevisions() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_message_revisions_duration_seconds",
+		Help: "Histogram for listMessageRevisions endpoint latency",
+	})
+
+	type listMessageRevisionsResponse struct {
+		Revisions []messageRevisionResponse `json:"revisions"`
+	}
+
+	const (
+		// Replaced versions come first, oldest to newest, followed by the
+		// current one. Messages other than text have no revisions.
+		selectRevisionsQueryString = `
+SELECT text, created_at, current
+	FROM (
+		SELECT id, text, created_at, false AS current
+			FROM message_revision
+			WHERE message_id = $1
+		UNION ALL
+		SELECT 0, text_message.text, coalesce(message.edited_at, message.created_at), true
+			FROM message
+				join text_message ON message.id = text_message.message_id
+			WHERE message.id = $1
+	) AS revisions
+	ORDER BY current, id
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		rows, err := s.db.Query(r.Context(), selectRevisionsQueryString, messageIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		revisions := []messageRevisionResponse{}
+		for rows.Next() {
+			var revision messageRevisionResponse
+			if err := rows.Scan(&revision.Text, &revision.CreatedAt, &revision.Current); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			revisions = append(revisions, revision)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, listMessageRevisionsResponse{Revisions: revisions})
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jackc/pgconn"
+)
+
+const (
+	// pgUniqueViolation is the postgres error code for a unique constraint violation
+	pgUniqueViolation = "23505"
+
+	// pgForeignKeyViolation is the postgres error code for a foreign key violation
+	pgForeignKeyViolation = "23503"
+)
+
+// Error is an error that is safe to show to API clients.
+//
+// Handlers return an *Error to control the HTTP status and the contents of the
+// JSON error envelope. Anything else is treated as an internal server error
+// and its message is only logged.
+type Error struct {
+	// Status is the HTTP status code to respond with
+	Status int `json:"-"`
+
+	// Code is a stable, machine readable identifier for the error
+	Code string `json:"code"`
+
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+
+	// Details is any additional structured information about the error
+	Details interface{} `json:"details,omitempty"`
+
+	// Err is the underlying cause, which is logged but never sent to clients
+	Err error `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the underlying cause of the error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type errorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+func errBadRequest(message string, err error) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "bad_request", Message: message, Err: err}
+}
+
+func errUnauthorized(message string) *Error {
+	return &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Message: message}
+}
+
+func errForbidden(message string) *Error {
+	return &Error{Status: http.StatusForbidden, Code: "forbidden", Message: message}
+}
+
+func errNotFound(message string) *Error {
+	return &Error{Status: http.StatusNotFound, Code: "not_found", Message: message}
+}
+
+func errConflict(message string, err error) *Error {
+	return &Error{Status: http.StatusConflict, Code: "conflict", Message: message, Err: err}
+}
+
+func errTooLarge(message string) *Error {
+	return &Error{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: message}
+}
+
+func errTooManyRequests(message string) *Error {
+	return &Error{Status: http.StatusTooManyRequests, Code: "too_many_requests", Message: message}
+}
+
+func errUnprocessable(message string, details interface{}) *Error {
+	return &Error{Status: http.StatusUnprocessableEntity, Code: "unprocessable_entity", Message: message, Details: details}
+}
+
+func errInternal(err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal_error", Message: http.StatusText(http.StatusInternalServerError), Err: err}
+}
+
+// isPGError reports whether err is a postgres error with the given code and,
+// if constraint is not empty, was raised by the given constraint
+func isPGError(err error, code string, constraint string) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == code && (constraint == "" || pgErr.ConstraintName == constraint)
+}
+
+// writeError renders err as a JSON error envelope
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = errInternal(err)
+	}
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		s.logger.Error().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("Request failed")
+	} else {
+		s.logger.Info().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Int("status", apiErr.Status).Msg("Request rejected")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(errorEnvelope{Error: apiErr})
+}
+
+// writeJSON renders v as a JSON response with the given status code
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error().Err(err).Msg("Couldn't encode response")
+	}
+}
+
+// decodeJSON reads the entire request body and unmarshals it into v. An empty
+// body leaves v untouched.
+func decodeJSON(r *http.Request, v interface{}) error {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return errBadRequest("Couldn't read request body", err)
+	}
+
+	if len(bodyBytes) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return errBadRequest("Request body is not valid JSON", err)
+	}
+
+	return nil
+}
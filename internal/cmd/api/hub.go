@@ -0,0 +1,144 @@
+package api
+
+import (
+	"sync"
+)
+
+const (
+	// subscriptionBuffer is how many events can be queued for a subscriber
+	// before it's considered too slow and is disconnected
+	subscriptionBuffer = 64
+
+	// messageEventName is the name of events for newly created messages
+	messageEventName = "message"
+
+	// reactionEventName is the name of events for reactions being added to
+	// and removed from messages
+	reactionEventName = "reaction"
+)
+
+// event is a single notification that's pushed to live subscribers
+type event struct {
+	// ID orders message events so that clients can resume from the last one
+	// they saw. Other events carry the ID of the message that they're about.
+	ID int64
+
+	// Name describes what kind of event this is
+	Name string
+
+	// Data is the payload of the event and is rendered as JSON
+	Data interface{}
+}
+
+// subscription receives every event published for a single user. The events
+// channel is closed when the subscriber falls too far behind or when the hub
+// shuts down.
+type subscription struct {
+	userID int64
+	events chan event
+}
+
+// hub fans events out to the live subscribers of this process
+type hub struct {
+	mu          sync.Mutex
+	closed      bool
+	subscribers map[int64]map[*subscription]struct{}
+}
+
+func newHub() *hub {
+	return &hub{
+		subscribers: map[int64]map[*subscription]struct{}{},
+	}
+}
+
+// subscribe registers a new subscription for all events sent to userID
+func (h *hub) subscribe(userID int64) *subscription {
+	sub := &subscription{
+		userID: userID,
+		events: make(chan event, subscriptionBuffer),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = map[*subscription]struct{}{}
+	}
+	h.subscribers[userID][sub] = struct{}{}
+
+	return sub
+}
+
+// unsubscribe removes a subscription. It's safe to call more than once.
+func (h *hub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// publish sends e to every subscriber of userID without blocking. Subscribers
+// whose buffer is full are disconnected so that they can reconnect and resume
+// from the last event they saw.
+func (h *hub) publish(userID int64, e event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[userID] {
+		select {
+		case sub.events <- e:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+// hasSubscribers reports whether anybody is subscribed to userID's events
+func (h *hub) hasSubscribers(userID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[userID]) > 0
+}
+
+// subscribedUserIDs returns every user that has at least one subscriber
+func (h *hub) subscribedUserIDs() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	userIDs := make([]int64, 0, len(h.subscribers))
+	for userID := range h.subscribers {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// close disconnects every subscriber and rejects any new subscriptions
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// remove must be called while holding h.mu
+func (h *hub) remove(sub *subscription) {
+	subs := h.subscribers[sub.userID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+	close(sub.events)
+}
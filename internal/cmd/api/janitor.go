@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// janitorInterval is how often the janitor cleans up after everything
+	// else
+	janitorInterval = 10 * time.Minute
+
+	// janitorQueryTimeout bounds each query that the janitor makes
+	janitorQueryTimeout = time.Minute
+
+	// orphanedBlobAge is how long a blob can go without being attached to a
+	// message before it's deleted. It's long enough for an upload to be sent,
+	// and blobs whose messages were deleted for everyone are long past it.
+	orphanedBlobAge = 24 * time.Hour
+
+	// orphanedBlobBatchSize is how many blobs are deleted at a time, so that
+	// a backlog doesn't hold locks on all of them at once
+	orphanedBlobBatchSize = 100
+)
+
+// janitor periodically deletes what nothing refers to anymore. Every replica
+// runs one, and they skip over whatever another replica is working on.
+type janitor struct {
+	server               *Server
+	blobsDeleted         prometheus.Counter
+	loginAttemptsDeleted prometheus.Counter
+}
+
+func (s *Server) newJanitor() *janitor {
+	return &janitor{
+		server: s,
+		blobsDeleted: s.metrics.NewCounter(prometheus.CounterOpts{
+			Name: "chat_janitor_blobs_deleted_total",
+			Help: "Counter for blobs that were deleted because no message was attached to them",
+		}),
+		loginAttemptsDeleted: s.metrics.NewCounter(prometheus.CounterOpts{
+			Name: "chat_janitor_login_attempts_deleted_total",
+			Help: "Counter for login_attempt rows that were deleted because they'd been forgotten",
+		}),
+	}
+}
+
+// run cleans up every janitorInterval until ctx is cancelled
+func (j *janitor) run(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		j.deleteOrphanedBlobs(ctx)
+		j.deleteStaleLoginAttempts(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deleteOrphanedBlobs deletes blobs older than orphanedBlobAge that no file
+// or audio message is attached to, both their rows and their contents
+func (j *janitor) deleteOrphanedBlobs(ctx context.Context) {
+	// Attaching a blob takes a key share lock on it, so one that's being
+	// attached right now is skipped
+	const deleteOrphanedBlobsQueryString = `
+DELETE FROM blob
+	WHERE id IN (
+		SELECT id
+			FROM blob
+			WHERE created_at < now() - $1::interval
+				AND NOT EXISTS (SELECT 1 FROM file_message WHERE file_message.blob_id = blob.id)
+				AND NOT EXISTS (SELECT 1 FROM audio_message WHERE audio_message.blob_id = blob.id)
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id::text
+`
+
+	for ctx.Err() == nil {
+		blobIDs, err := j.deleteOrphanedBlobRows(ctx, deleteOrphanedBlobsQueryString)
+		if err != nil {
+			j.server.logger.Error().Err(err).Msg("Couldn't delete orphaned blobs")
+			return
+		}
+
+		// The rows are gone, so a file that can't be deleted now never will
+		// be. It's logged so that it can be cleaned up by hand.
+		for _, blobID := range blobIDs {
+			if err := j.server.blobStore.Delete(ctx, blobID); err != nil {
+				j.server.logger.Error().Err(err).Str("blob", blobID).Msg("Couldn't delete orphaned blob from the store")
+			}
+		}
+		j.blobsDeleted.Add(float64(len(blobIDs)))
+
+		if len(blobIDs) < orphanedBlobBatchSize {
+			return
+		}
+	}
+}
+
+func (j *janitor) deleteOrphanedBlobRows(ctx context.Context, query string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, janitorQueryTimeout)
+	defer cancel()
+
+	rows, err := j.server.db.Query(ctx, query, orphanedBlobAge, orphanedBlobBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobIDs []string
+	for rows.Next() {
+		var blobID string
+		if err := rows.Scan(&blobID); err != nil {
+			return nil, err
+		}
+		blobIDs = append(blobIDs, blobID)
+	}
+	return blobIDs, rows.Err()
+}
+
+// deleteStaleLoginAttempts deletes the failures of keys that have been quiet
+// for longer than loginFailureWindow and aren't locked out. They'd start
+// counting from scratch anyway.
+func (j *janitor) deleteStaleLoginAttempts(ctx context.Context) {
+	const deleteStaleLoginAttemptsQueryString = `
+DELETE FROM login_attempt
+	WHERE last_failure_at < now() - $1::interval
+		AND (locked_until IS NULL OR locked_until < now())
+`
+
+	ctx, cancel := context.WithTimeout(ctx, janitorQueryTimeout)
+	defer cancel()
+
+	tag, err := j.server.db.Exec(ctx, deleteStaleLoginAttemptsQueryString, loginFailureWindow)
+	if err != nil {
+		j.server.logger.Error().Err(err).Msg("Couldn't delete stale login attempts")
+		return
+	}
+	j.loginAttemptsDeleted.Add(float64(tag.RowsAffected()))
+}
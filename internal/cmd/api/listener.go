@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// messagesChannel is the postgres NOTIFY channel that createMessage
+	// announces new messages on
+	messagesChannel = "chat_messages"
+
+	// listenerMinBackoff is how long to wait before the first attempt to
+	// reconnect a dropped listener connection
+	listenerMinBackoff = 1 * time.Second
+
+	// listenerMaxBackoff caps the exponential backoff between reconnects
+	listenerMaxBackoff = 30 * time.Second
+
+	// listenerQueryTimeout bounds each query that the listener makes
+	listenerQueryTimeout = 5 * time.Second
+
+	// catchUpMessagesQueryString selects every message in a conversation that
+	// one of the users in $2 is a member of, and that's either after the
+	// message ID $1 or was created within $3 of it and so might have committed
+	// after it did
+	catchUpMessagesQueryString = `
+SELECT DISTINCT message.id AS message_id
+	FROM message
+		join conversation_member ON conversation_member.conversation_id = message.conversation_id
+	WHERE (
+			message.id > $1
+			OR message.created_at >= (SELECT created_at FROM message WHERE id = $1) - $3::interval
+		)
+		AND conversation_member.user_id = ANY($2)
+`
+
+	// recipientsQueryString selects every member of the conversation $1 other
+	// than the sender $2
+	recipientsQueryString = `
+SELECT user_id
+	FROM conversation_member
+	WHERE conversation_id = $1
+		AND user_id <> $2
+`
+)
+
+// messageNotification is the payload of a NOTIFY on messagesChannel. The
+// message itself isn't included because NOTIFY payloads are limited to 8000
+// bytes.
+type messageNotification struct {
+	ID           int64 `json:"id"`
+	Conversation int64 `json:"conversation"`
+	Sender       int64 `json:"sender"`
+}
+
+// listener holds a dedicated postgres connection that LISTENs for new
+// messages and reactions written by any replica and fans them out to this
+// replica's hub
+type listener struct {
+	server     *Server
+	pool       *pgxpool.Pool
+	reconnects prometheus.Counter
+
+	// started is set once the first LISTEN succeeds. Every LISTEN after that is
+	// a reconnect and needs to catch up on whatever was missed.
+	started bool
+
+	// lastID is the highest message ID that the listener knows about
+	lastID int64
+
+	// published holds the timestamp of every message that was published
+	// recently enough to come up again when catching up, so that nobody gets
+	// it twice
+	published map[int64]time.Time
+
+	// prunedAt is the timestamp of the message that published was last
+	// pruned at
+	prunedAt time.Time
+}
+
+func (s *Server) newListener(pool *pgxpool.Pool) *listener {
+	return &listener{
+		server:    s,
+		pool:      pool,
+		published: map[int64]time.Time{},
+		reconnects: s.metrics.NewCounter(prometheus.CounterOpts{
+			Name: "chat_listener_reconnects_total",
+			Help: "Counter for how many times the postgres listener connection was re-established",
+		}),
+	}
+}
+
+// run listens for notifications until ctx is cancelled, reconnecting with
+// exponential backoff whenever the connection is lost
+func (l *listener) run(ctx context.Context) {
+	backoff := listenerMinBackoff
+	for {
+		err := l.listen(ctx, func() { backoff = listenerMinBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+
+		l.server.logger.Error().Err(err).Dur("backoff", backoff).Msg("Lost postgres listener connection")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > listenerMaxBackoff {
+			backoff = listenerMaxBackoff
+		}
+		l.reconnects.Inc()
+	}
+}
+
+// listen runs a single listener connection until it fails. onListening is
+// called once notifications are flowing.
+func (l *listener) listen(ctx context.Context, onListening func()) error {
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Never hand a connection that's still LISTENing back to the pool
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	for _, channel := range []string{messagesChannel, reactionsChannel} {
+		if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+			return err
+		}
+	}
+
+	if err := l.catchUp(ctx); err != nil {
+		return err
+	}
+	onListening()
+	l.server.logger.Info().Msg("Listening for new messages")
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		if notification.Channel == reactionsChannel {
+			var payload reactionNotification
+			if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+				l.server.logger.Error().Err(err).Str("payload", notification.Payload).Msg("Couldn't parse reaction notification")
+				continue
+			}
+			if err := l.deliverReaction(ctx, payload); err != nil {
+				l.server.logger.Error().Err(err).Int64("messageID", payload.Message).Msg("Couldn't deliver reaction notification")
+			}
+			continue
+		}
+
+		var payload messageNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+			l.server.logger.Error().Err(err).Str("payload", notification.Payload).Msg("Couldn't parse message notification")
+			continue
+		}
+		if err := l.deliver(ctx, payload); err != nil {
+			l.server.logger.Error().Err(err).Int64("messageID", payload.ID).Msg("Couldn't deliver message notification")
+		}
+	}
+}
+
+// deliver publishes a newly created message to its local subscribers, if
+// there are any
+func (l *listener) deliver(ctx context.Context, payload messageNotification) error {
+	// Notifications come in commit order, which isn't always ID order, so
+	// the only ones to skip are those that catching up already published
+	if _, ok := l.published[payload.ID]; ok {
+		return nil
+	}
+	if payload.ID > l.lastID {
+		l.lastID = payload.ID
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, listenerQueryTimeout)
+	defer cancel()
+
+	recipients, err := l.localRecipients(ctx, payload.Conversation, payload.Sender)
+	if err != nil || len(recipients) == 0 {
+		return err
+	}
+
+	messages, err := l.server.queryMessages(ctx, l.server.db, messageByIDQueryString, payload.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		l.publish(recipients, message)
+	}
+	return nil
+}
+
+// deliverReaction publishes a reaction being added or removed to the local
+// subscribers in the message's conversation, other than whoever reacted.
+// Reactions aren't caught up on after a reconnect since listings always have
+// the current counts.
+func (l *listener) deliverReaction(ctx context.Context, payload reactionNotification) error {
+	ctx, cancel := context.WithTimeout(ctx, listenerQueryTimeout)
+	defer cancel()
+
+	recipients, err := l.localRecipients(ctx, payload.Conversation, payload.User)
+	if err != nil {
+		return err
+	}
+
+	e := event{
+		ID:   payload.Message,
+		Name: reactionEventName,
+		Data: reactionEvent{Event: reactionEventName, reactionNotification: payload},
+	}
+	for _, userID := range recipients {
+		l.server.hub.publish(userID, e)
+	}
+	return nil
+}
+
+// catchUp publishes every message that local subscribers missed while the
+// listener was disconnected
+func (l *listener) catchUp(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, listenerQueryTimeout)
+	defer cancel()
+
+	// The first time, there's nobody who could've missed anything
+	if !l.started {
+		if err := l.server.db.QueryRow(ctx, "SELECT coalesce(max(id), 0) FROM message").Scan(&l.lastID); err != nil {
+			return err
+		}
+		l.started = true
+		return nil
+	}
+
+	// Anything committed from here on also arrives as a notification, which
+	// deliver skips once it's been published here
+	userIDs := l.server.hub.subscribedUserIDs()
+	if len(userIDs) == 0 {
+		return nil
+	}
+	messages, err := l.server.queryMessages(ctx, l.server.db, catchUpMessagesQueryString, l.lastID, userIDs, messageCommitWindow)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if _, ok := l.published[message.ID]; ok {
+			continue
+		}
+		recipients, err := l.localRecipients(ctx, message.Conversation, message.Sender)
+		if err != nil {
+			return err
+		}
+		l.publish(recipients, message)
+		if message.ID > l.lastID {
+			l.lastID = message.ID
+		}
+	}
+	return nil
+}
+
+// localRecipients returns the members of a conversation, other than the
+// sender, that are subscribed to this replica's hub
+func (l *listener) localRecipients(ctx context.Context, conversationID int64, senderID int64) ([]int64, error) {
+	rows, err := l.server.db.Query(ctx, recipientsQueryString, conversationID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		if l.server.hub.hasSubscribers(userID) {
+			recipients = append(recipients, userID)
+		}
+	}
+	return recipients, rows.Err()
+}
+
+func (l *listener) publish(recipients []int64, message messageResponse) {
+	for _, userID := range recipients {
+		l.server.hub.publish(userID, event{ID: message.ID, Name: messageEventName, Data: message})
+	}
+
+	l.published[message.ID] = message.Timestamp
+	if message.Timestamp.Sub(l.prunedAt) < messageCommitWindow {
+		return
+	}
+
+	// Messages that are well outside the commit window of the newest one
+	// can't come up when catching up anymore
+	for id, timestamp := range l.published {
+		if message.Timestamp.Sub(timestamp) > 2*messageCommitWindow {
+			delete(l.published, id)
+		}
+	}
+	l.prunedAt = message.Timestamp
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// messageResponse is how a single message is rendered to clients, both when
+// listing messages and when pushing them to live subscribers
+type messageResponse struct {
+	ID           int64 `json:"id"`
+	Conversation int64 `json:"conversation"`
+	Sender       int64 `json:"sender"`
+	// Recipient is only set for direct messages
+	Recipient int64     `json:"recipient,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// EditedAt is when the message was last edited, or null if it never was
+	EditedAt *time.Time `json:"edited_at"`
+	// DeletedAt is when the sender deleted the message for everyone, or null
+	// if they didn't. Deleted messages have content of type deleted.
+	DeletedAt *time.Time             `json:"deleted_at"`
+	Content   map[string]interface{} `json:"content"`
+	// ReplyTo is a preview of the message that this one replies to, or null if
+	// it isn't a reply
+	ReplyTo *messagePreview `json:"reply_to"`
+	// Thread is the first message of the thread that this reply is in, or
+	// null if it isn't a reply
+	Thread *int64 `json:"thread"`
+	// ReplyCount is how many replies are in the thread that this message
+	// starts
+	ReplyCount int64 `json:"reply_count"`
+	// Reactions are only filled in for listings, where they're left out when
+	// there are none
+	Reactions []reactionSummary `json:"reactions,omitempty"`
+	// ReadBy is every other member who has read the message. It's only filled
+	// in for listings, where it's left out when nobody has.
+	ReadBy []int64 `json:"read_by,omitempty"`
+}
+
+// messagePreview is just enough of a message to show what a reply is about
+type messagePreview struct {
+	ID     int64  `json:"id"`
+	Sender int64  `json:"sender"`
+	Type   string `json:"type"`
+	// Text is the start of the message for text messages
+	Text string `json:"text,omitempty"`
+}
+
+// createMessageResponse is the response for every endpoint that creates a message
+type createMessageResponse struct {
+	ID        int64  `json:"id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// newMessage is a message that's about to be written
+type newMessage struct {
+	SenderID       int64
+	ConversationID int64
+	// RecipientID is only set for direct messages
+	RecipientID *int64
+	ContentType ContentType
+	Content     Content
+	// ReplyToID is the message that this one replies to, if any
+	ReplyToID *int64
+}
+
+const (
+	createMessageQueryString = `
+INSERT INTO message (sender_id, recipient_id, conversation_id, message_type_id, reply_to_id, root_id)
+	SELECT $1, $2, $3, message_type.id, $5, $6
+		FROM message_type
+		WHERE message_type.name = $4
+	RETURNING id, created_at
+`
+
+	// A key share lock keeps the parent from being deleted before the reply
+	// is written. Unlike FOR SHARE, it doesn't stop the reply count from
+	// being bumped when the parent is also the root.
+	selectParentQueryString = "SELECT conversation_id, coalesce(root_id, id) FROM message WHERE id = $1 FOR KEY SHARE"
+
+	// Replies to the same thread take turns bumping its reply count. Taking
+	// the lock up front, rather than with the UPDATE, means that no reply
+	// holds a lock on the root that another one is waiting to upgrade.
+	lockRootQueryString = "SELECT 1 FROM message WHERE id = $1 FOR NO KEY UPDATE"
+
+	incrementReplyCountQueryString = "UPDATE message SET reply_count = reply_count + 1 WHERE id = $1"
+
+	notifyQueryString = "SELECT pg_notify($1, $2)"
+)
+
+// messageCommitWindow is how long a message can take to commit after it's
+// created. IDs are handed out before commit, so a message can become visible
+// after one with a higher ID. Readers that resume from an ID look back this
+// far for messages like that.
+const messageCommitWindow = 10 * time.Second
+
+// insertMessage writes m and its content within tx. It also queues a
+// notification for every replica's listener, which postgres only sends once
+// tx commits. Callers have to commit well within messageCommitWindow.
+func insertMessage(ctx context.Context, tx pgx.Tx, m newMessage) (int64, time.Time, error) {
+	var rootID *int64
+	if m.ReplyToID != nil {
+		var parentConversationID, parentRootID int64
+		err := tx.QueryRow(ctx, selectParentQueryString, *m.ReplyToID).Scan(&parentConversationID, &parentRootID)
+		if err != nil && err != pgx.ErrNoRows {
+			return 0, time.Time{}, err
+		}
+		// Messages in other conversations are reported the same as missing
+		// ones so that their existence isn't leaked
+		inConversation := err == nil && parentConversationID == m.ConversationID
+		err = validate(
+			field("reply_to", *m.ReplyToID, ensure(inConversation, "must be a message in the same conversation")),
+		)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		rootID = &parentRootID
+
+		var locked int
+		err = tx.QueryRow(ctx, lockRootQueryString, parentRootID).Scan(&locked)
+		if err == pgx.ErrNoRows {
+			return 0, time.Time{}, validate(
+				field("reply_to", *m.ReplyToID, ensure(false, "must be a message in the same conversation")),
+			)
+		} else if err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	var messageID int64
+	var createdAt time.Time
+	err := tx.QueryRow(ctx,
+		createMessageQueryString,
+		m.SenderID,
+		m.RecipientID,
+		m.ConversationID,
+		m.ContentType.Name(),
+		m.ReplyToID,
+		rootID).Scan(&messageID, &createdAt)
+	if err == pgx.ErrNoRows {
+		// The INSERT ... SELECT doesn't insert anything when the message type doesn't exist
+		return 0, time.Time{}, errUnprocessable("Unknown message type", map[string]string{"type": m.ContentType.Name()})
+	} else if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if err := m.Content.Insert(ctx, tx, messageID); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if rootID != nil {
+		if _, err := tx.Exec(ctx, incrementReplyCountQueryString, *rootID); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	payload, err := json.Marshal(messageNotification{
+		ID:           messageID,
+		Conversation: m.ConversationID,
+		Sender:       m.SenderID,
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if _, err := tx.Exec(ctx, notifyQueryString, messagesChannel, string(payload)); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return messageID, createdAt, nil
+}
+
+// messageIDContextKey is where messageMemberRequired stores the ID of the
+// message from the URL
+const messageIDContextKey contextKey = "messageID"
+
+// messageIDFromContext returns the message ID that was placed into the
+// request context by messageMemberRequired
+func messageIDFromContext(ctx context.Context) int64 {
+	messageID, _ := ctx.Value(messageIDContextKey).(int64)
+	return messageID
+}
+
+// messageMemberRequired rejects requests for messages in conversations that
+// the caller isn't a member of. Messages that the caller can't see are
+// reported as not found so that their existence isn't leaked. The message's
+// conversation is stored in the context too.
+func (s *Server) messageMemberRequired() func(http.Handler) http.Handler {
+	const selectConversationQueryString = `
+SELECT message.conversation_id
+	FROM message
+		join conversation_member ON conversation_member.conversation_id = message.conversation_id
+	WHERE message.id = $1
+		AND conversation_member.user_id = $2
+`
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			messageID, err := int64URLParam(r, "messageID")
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+
+			var conversationID int64
+			err = s.db.QueryRow(r.Context(), selectConversationQueryString, messageID, userIDFromContext(r.Context())).Scan(&conversationID)
+			if err == pgx.ErrNoRows {
+				s.writeError(w, r, errNotFound("Message not found"))
+				return
+			} else if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), messageIDContextKey, messageID)
+			ctx = context.WithValue(ctx, conversationIDContextKey, conversationID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// messageByIDQueryString selects the single message with the ID $1
+const messageByIDQueryString = "SELECT $1::bigint AS message_id"
+
+// querier is satisfied by both PGDB and pgx.Tx so that messages can be read
+// inside or outside of a transaction
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// queryMessages returns every message selected by desiredMessagesQuery in
+// ascending ID order. desiredMessagesQuery must select message IDs as
+// message_id.
+func (s *Server) queryMessages(ctx context.Context, q querier, desiredMessagesQuery string, args ...interface{}) ([]messageResponse, error) {
+	rows, err := q.Query(ctx, s.contentTypes.selectMessagesQuery(desiredMessagesQuery), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []messageResponse{}
+	for rows.Next() {
+		var m messageResponse
+		if err := rows.Scan(&m.ID, &m.Conversation, &m.Sender, &m.Recipient, &m.Timestamp, &m.EditedAt, &m.DeletedAt, &m.Content, &m.ReplyTo, &m.Thread, &m.ReplyCount); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
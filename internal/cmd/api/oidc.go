@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/abatilo/chat/internal/oidc"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// oidcLoginLifetime is how long a user has to sign in at the provider and
+	// come back to the callback
+	oidcLoginLifetime = 10 * time.Minute
+
+	// sessionOIDCStateKey is the session key for the state that the callback
+	// has to come back with
+	sessionOIDCStateKey = "oidcState"
+
+	// sessionOIDCNonceKey is the session key for the nonce that the ID token
+	// has to carry
+	sessionOIDCNonceKey = "oidcNonce"
+
+	// sessionOIDCVerifierKey is the session key for the PKCE code verifier
+	sessionOIDCVerifierKey = "oidcVerifier"
+
+	// sessionOIDCExpiresAtKey is the session key for the Unix time that the
+	// pending sign in expires at
+	sessionOIDCExpiresAtKey = "oidcExpiresAt"
+)
+
+// clearOIDCLogin forgets any pending sign in with the provider, so that each
+// one can only come back to the callback once
+func (s *Server) clearOIDCLogin(r *http.Request) {
+	s.sessionManager.Remove(r.Context(), sessionOIDCStateKey)
+	s.sessionManager.Remove(r.Context(), sessionOIDCNonceKey)
+	s.sessionManager.Remove(r.Context(), sessionOIDCVerifierKey)
+	s.sessionManager.Remove(r.Context(), sessionOIDCExpiresAtKey)
+}
+
+func (s *Server) oidcLogin() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_oidc_login_duration_seconds",
+		Help: "Histogram for oidcLogin endpoint latency",
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		var values [3]string
+		for i := range values {
+			value, err := oidc.RandomString()
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			values[i] = value
+		}
+		state, nonce, verifier := values[0], values[1], values[2]
+
+		authURL, err := s.oidcProvider.AuthCodeURL(r.Context(), state, nonce, oidc.CodeChallenge(verifier))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.sessionManager.Put(r.Context(), sessionOIDCStateKey, state)
+		s.sessionManager.Put(r.Context(), sessionOIDCNonceKey, nonce)
+		s.sessionManager.Put(r.Context(), sessionOIDCVerifierKey, verifier)
+		s.sessionManager.Put(r.Context(), sessionOIDCExpiresAtKey, time.Now().Add(oidcLoginLifetime).Unix())
+
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func (s *Server) oidcCallback() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_oidc_callback_duration_seconds",
+		Help: "Histogram for oidcCallback endpoint latency",
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		state, _ := s.sessionManager.Get(r.Context(), sessionOIDCStateKey).(string)
+		nonce, _ := s.sessionManager.Get(r.Context(), sessionOIDCNonceKey).(string)
+		verifier, _ := s.sessionManager.Get(r.Context(), sessionOIDCVerifierKey).(string)
+		expiresAt, _ := s.sessionManager.Get(r.Context(), sessionOIDCExpiresAtKey).(int64)
+		s.clearOIDCLogin(r)
+
+		query := r.URL.Query()
+		if state == "" || time.Now().Unix() > expiresAt || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			s.writeError(w, r, errUnauthorized("No sign in is waiting for this callback"))
+			return
+		}
+
+		if providerError := query.Get("error"); providerError != "" {
+			s.writeError(w, r, errUnauthorized("The provider didn't sign you in: "+providerError))
+			return
+		}
+
+		err := validate(
+			field("code", query.Get("code"), required),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		idToken, err := s.oidcProvider.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+		if err != nil {
+			s.logger.Info().Err(err).Msg("Couldn't exchange authorization code")
+			s.writeError(w, r, errUnauthorized("Couldn't sign in with the provider"))
+			return
+		}
+
+		userID, twoFactorEnabled, err := s.userForIdentity(r.Context(), idToken)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if twoFactorEnabled {
+			s.startTwoFactorChallenge(w, r, userID)
+			return
+		}
+
+		tokens, err := s.createSession(r.Context(), userID, clientFromRequest(r))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+// userForIdentity finds the user that an identity at the provider is linked
+// to. The first time an identity signs in, a user is created for it.
+//
+// Users are never linked by email address, since that would let anyone who
+// can get the provider to vouch for an address take over the account that
+// registered it here.
+func (s *Server) userForIdentity(ctx context.Context, idToken *oidc.IDToken) (int64, bool, error) {
+	const (
+		selectIdentityQueryString = `
+SELECT chat_user.id, chat_user.totp_enabled_at IS NOT NULL, chat_user.disabled_at IS NOT NULL
+	FROM user_identity
+	JOIN chat_user ON chat_user.id = user_identity.user_id
+	WHERE user_identity.issuer = $1
+		AND user_identity.subject = $2
+`
+
+		touchIdentityQueryString = "UPDATE user_identity SET last_login_at = now() WHERE issuer = $1 AND subject = $2"
+
+		usernameTakenQueryString = "SELECT EXISTS (SELECT 1 FROM chat_user WHERE username = $1)"
+
+		emailTakenQueryString = "SELECT EXISTS (SELECT 1 FROM chat_user WHERE lower(email) = lower($1))"
+
+		insertUserQueryString = "INSERT INTO chat_user (username, password, email) VALUES ($1, $2, nullif($3, '')) RETURNING id"
+
+		insertIdentityQueryString = "INSERT INTO user_identity (user_id, issuer, subject) VALUES ($1, $2, $3)"
+	)
+
+	var userID int64
+	var twoFactorEnabled, disabled bool
+	err := s.db.QueryRow(ctx, selectIdentityQueryString, idToken.Issuer, idToken.Subject).Scan(&userID, &twoFactorEnabled, &disabled)
+	if err == nil {
+		if disabled {
+			return 0, false, errForbidden("Account is disabled")
+		}
+		if _, err := s.db.Exec(ctx, touchIdentityQueryString, idToken.Issuer, idToken.Subject); err != nil {
+			return 0, false, errInternal(err)
+		}
+		return userID, twoFactorEnabled, nil
+	} else if err != pgx.ErrNoRows {
+		return 0, false, errInternal(err)
+	}
+
+	// The provider's username is kept when it's valid and free here
+	username := idToken.PreferredUsername
+	taken := !usernamePattern.MatchString(username)
+	if !taken {
+		if err := s.db.QueryRow(ctx, usernameTakenQueryString, username).Scan(&taken); err != nil {
+			return 0, false, errInternal(err)
+		}
+	}
+	if taken {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return 0, false, errInternal(err)
+		}
+		username = "user-" + hex.EncodeToString(suffix)
+	}
+
+	// Only an address that the provider verified is stored, since it's what
+	// password resets are sent to
+	email := ""
+	if idToken.EmailVerified && validate(field("email", idToken.Email, maxLength(maxEmailLength), emailAddress)) == nil {
+		var emailTaken bool
+		if err := s.db.QueryRow(ctx, emailTakenQueryString, idToken.Email).Scan(&emailTaken); err != nil {
+			return 0, false, errInternal(err)
+		}
+		if !emailTaken {
+			email = idToken.Email
+		}
+	}
+
+	// Nobody knows the password until they set one with a password reset
+	unusablePassword, err := oidc.RandomString()
+	if err != nil {
+		return 0, false, errInternal(err)
+	}
+	hashedPassword, err := s.hashPassword(ctx, unusablePassword)
+	if err != nil {
+		return 0, false, errInternal(err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, false, errInternal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, insertUserQueryString, username, hashedPassword, email).Scan(&userID)
+	if isPGError(err, pgUniqueViolation, "") {
+		// Someone took the username or email since we looked
+		return 0, false, errConflict("Couldn't create a user for this sign in, try again", err)
+	} else if err != nil {
+		return 0, false, errInternal(err)
+	}
+
+	_, err = tx.Exec(ctx, insertIdentityQueryString, userID, idToken.Issuer, idToken.Subject)
+	if isPGError(err, pgUniqueViolation, "") {
+		// The same identity signed in twice at once
+		return 0, false, errConflict("Couldn't create a user for this sign in, try again", err)
+	} else if err != nil {
+		return 0, false, errInternal(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, false, errInternal(err)
+	}
+
+	return userID, false, nil
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+const (
+	// defaultPageLimit is how many messages are returned when the client
+	// doesn't ask for a specific amount
+	defaultPageLimit = 50
+
+	// maxPageLimit is the most messages that a single page can hold
+	maxPageLimit = 200
+
+	// pageForwardQueryFormat selects up to $2 messages newer than $1 that also
+	// match the filter and that the viewer $3 hasn't hidden. The filter's own
+	// placeholders start at $4. A message can commit after one with a higher
+	// ID, so polling next_cursor can miss it. The streams look back
+	// messageCommitWindow to catch those.
+	pageForwardQueryFormat = `
+SELECT id AS message_id
+	FROM message
+	WHERE (%s)
+		AND id > $1
+		AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $3)
+	ORDER BY id
+	LIMIT $2
+`
+
+	// pageBackwardQueryFormat selects up to $2 messages older than $1 that
+	// also match the filter and that the viewer $3 hasn't hidden. The filter's
+	// own placeholders start at $4.
+	pageBackwardQueryFormat = `
+SELECT id AS message_id
+	FROM message
+	WHERE (%s)
+		AND id < $1
+		AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $3)
+	ORDER BY id DESC
+	LIMIT $2
+`
+)
+
+// messageCursor is the position that a page of messages starts from. Clients
+// only ever see it as an opaque string.
+type messageCursor struct {
+	// After pages forward through messages newer than this ID
+	After int64 `json:"a,omitempty"`
+
+	// Before pages backward through messages older than this ID
+	Before int64 `json:"b,omitempty"`
+}
+
+func (c messageCursor) backward() bool {
+	return c.Before > 0
+}
+
+func (c messageCursor) encode() *string {
+	raw, _ := json.Marshal(c)
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+	return &encoded
+}
+
+func decodeMessageCursor(encoded string) (messageCursor, error) {
+	var c messageCursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(raw, &c)
+	}
+	if err != nil || c.After < 0 || c.Before < 0 || (c.After > 0 && c.Before > 0) {
+		return messageCursor{}, errBadRequest("cursor is invalid", err)
+	}
+	return c, nil
+}
+
+// messagePageRequest is where a page of messages starts and how big it is
+type messagePageRequest struct {
+	Cursor messageCursor
+	Limit  int64
+}
+
+// parseMessagePageRequest reads the cursor and limit query parameters. Without
+// a cursor the first page is the newest messages, or the oldest messages when
+// from=oldest.
+func parseMessagePageRequest(r *http.Request) (messagePageRequest, error) {
+	limit, err := int64QueryParam(r, "limit", defaultPageLimit)
+	if err != nil {
+		return messagePageRequest{}, err
+	}
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	page := messagePageRequest{Limit: limit}
+	if encoded := r.URL.Query().Get("cursor"); encoded != "" {
+		page.Cursor, err = decodeMessageCursor(encoded)
+		return page, err
+	}
+
+	switch from := r.URL.Query().Get("from"); from {
+	case "", "newest":
+		page.Cursor = messageCursor{Before: math.MaxInt64}
+	case "oldest":
+		page.Cursor = messageCursor{After: 0}
+	default:
+		return messagePageRequest{}, errBadRequest("from must be either newest or oldest", nil)
+	}
+	return page, nil
+}
+
+// messagePage is a single page of messages in ascending ID order, along with
+// the cursors to the pages around it
+type messagePage struct {
+	Messages []messageResponse `json:"messages"`
+
+	// NextCursor pages toward newer messages. It's always present so that
+	// clients can poll it for messages that haven't been written yet.
+	NextCursor *string `json:"next_cursor"`
+
+	// PrevCursor pages toward older messages. It's null once there's nothing
+	// older left to read.
+	PrevCursor *string `json:"prev_cursor"`
+}
+
+// pageMessages reads a single page of the messages that match filter, a SQL
+// condition on the message table whose placeholders start at $4. Messages
+// that viewerID deleted for themselves are left out.
+func (s *Server) pageMessages(ctx context.Context, viewerID int64, filter string, filterArgs []interface{}, page messagePageRequest) (messagePage, error) {
+	queryFormat := pageForwardQueryFormat
+	position := page.Cursor.After
+	if page.Cursor.backward() {
+		queryFormat = pageBackwardQueryFormat
+		position = page.Cursor.Before
+	}
+
+	// Ask for one extra message to find out whether there's another page
+	args := append([]interface{}{position, page.Limit + 1, viewerID}, filterArgs...)
+	messages, err := s.queryMessages(ctx, s.db, fmt.Sprintf(queryFormat, filter), args...)
+	if err != nil {
+		return messagePage{}, err
+	}
+
+	hasMore := int64(len(messages)) > page.Limit
+	if hasMore && page.Cursor.backward() {
+		// Messages are always in ascending order so the extra one is the oldest
+		messages = messages[1:]
+	} else if hasMore {
+		messages = messages[:len(messages)-1]
+	}
+
+	if err := s.loadReactions(ctx, viewerID, messages); err != nil {
+		return messagePage{}, err
+	}
+	if err := s.loadReadBy(ctx, messages); err != nil {
+		return messagePage{}, err
+	}
+
+	result := messagePage{Messages: messages}
+	if len(messages) == 0 {
+		if page.Cursor.backward() {
+			// There's nothing older, so the next page is everything from the
+			// cursor onward
+			result.NextCursor = messageCursor{After: 0}.encode()
+			if page.Cursor.Before != math.MaxInt64 {
+				result.NextCursor = messageCursor{After: page.Cursor.Before - 1}.encode()
+			}
+		} else {
+			result.NextCursor = page.Cursor.encode()
+			if page.Cursor.After > 0 {
+				result.PrevCursor = messageCursor{Before: page.Cursor.After + 1}.encode()
+			}
+		}
+		return result, nil
+	}
+
+	first, last := messages[0].ID, messages[len(messages)-1].ID
+	result.NextCursor = messageCursor{After: last}.encode()
+	if (page.Cursor.backward() && hasMore) || (!page.Cursor.backward() && page.Cursor.After > 0) {
+		result.PrevCursor = messageCursor{Before: first}.encode()
+	}
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// int64URLParam parses a positive ID out of the URL path. A malformed ID
+// can't match anything, so it's reported as not found.
+func int64URLParam(r *http.Request, name string) (int64, error) {
+	value, err := strconv.ParseInt(chi.URLParam(r, name), 10, 64)
+	if err != nil || value <= 0 {
+		return 0, errNotFound("Not found")
+	}
+	return value, nil
+}
+
+// int64QueryParam parses a non-negative integer out of the query string,
+// returning fallback when it's missing
+func int64QueryParam(r *http.Request, name string, fallback int64) (int64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errBadRequest(name+" must be a non-negative integer", err)
+	}
+	return value, nil
+}
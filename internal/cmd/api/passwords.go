@@ -0,0 +1,400 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abatilo/chat/internal/mail"
+	"github.com/abatilo/chat/internal/password"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// passwordResetLifetime is how long a password reset token stays valid
+	passwordResetLifetime = time.Hour
+
+	// defaultMaxPasswordHashes is how many passwords can be hashed or
+	// verified at once when the server isn't configured with a limit. With
+	// the default argon2id policy that's 256 MiB.
+	defaultMaxPasswordHashes = 4
+
+	// passwordResetSendTimeout bounds how long creating and emailing a
+	// password reset token can take
+	passwordResetSendTimeout = time.Minute
+)
+
+func (s *Server) maxPasswordHashes() int {
+	if s.config.MaxPasswordHashes > 0 {
+		return s.config.MaxPasswordHashes
+	}
+	return defaultMaxPasswordHashes
+}
+
+// acquirePasswordSlot waits for a turn to hash or verify a password. Requests
+// that give up while they wait don't take one.
+func (s *Server) acquirePasswordSlot(ctx context.Context) error {
+	select {
+	case s.passwordSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) releasePasswordSlot() {
+	<-s.passwordSlots
+}
+
+// hashPassword hashes plaintext under the current policy once there's a slot
+// for it
+func (s *Server) hashPassword(ctx context.Context, plaintext string) (string, error) {
+	if err := s.acquirePasswordSlot(ctx); err != nil {
+		return "", err
+	}
+	defer s.releasePasswordSlot()
+	return s.passwordHasher.Hash(plaintext)
+}
+
+// verifyPassword checks plaintext against hash once there's a slot for it
+func (s *Server) verifyPassword(ctx context.Context, hash, plaintext string) error {
+	if err := s.acquirePasswordSlot(ctx); err != nil {
+		return err
+	}
+	defer s.releasePasswordSlot()
+	return password.Verify(hash, plaintext)
+}
+
+// rehashPassword replaces userID's password hash with one made under the
+// current policy. It only logs failures because the old hash still works.
+func (s *Server) rehashPassword(ctx context.Context, userID int64, oldHash, plaintext string) {
+	// Matching on the old hash keeps this from undoing a password change that
+	// happened in the meantime
+	const rehashPasswordQueryString = "UPDATE chat_user SET password = $3 WHERE id = $1 AND password = $2"
+
+	newHash, err := s.hashPassword(ctx, plaintext)
+	if err != nil {
+		s.logger.Error().Err(err).Int64("user", userID).Msg("Couldn't rehash password")
+		return
+	}
+
+	if _, err := s.db.Exec(ctx, rehashPasswordQueryString, userID, oldHash, newHash); err != nil {
+		s.logger.Error().Err(err).Int64("user", userID).Msg("Couldn't store rehashed password")
+	}
+}
+
+// missingUserPasswordHash is compared against when a login names a user that
+// doesn't exist, so that it takes as long as a real comparison
+func (s *Server) missingUserPasswordHash() string {
+	s.missingUserHashOnce.Do(func() {
+		hash, err := s.hashPassword(context.Background(), uuid.New().String())
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Couldn't create password hash for missing users")
+		}
+		s.missingUserHash = hash
+	})
+	return s.missingUserHash
+}
+
+func (s *Server) changePassword() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_change_password_duration_seconds",
+		Help: "Histogram for changePassword endpoint latency",
+	})
+
+	type changePasswordRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	const (
+		selectPasswordQueryString = "SELECT username, password FROM chat_user WHERE id = $1 FOR UPDATE"
+		updatePasswordQueryString = "UPDATE chat_user SET password = $2 WHERE id = $1"
+	)
+
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_change_password_lockouts_total",
+		Help: "Counter for password changes that were locked out after too many wrong passwords",
+	}, []string{"scope"})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct changePasswordRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("current_password", requestStruct.CurrentPassword, required, maxBytes(maxPasswordBytes)),
+			field("new_password", requestStruct.NewPassword, required, maxBytes(maxPasswordBytes), strongPassword),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var username, hashedPassword string
+		if err := tx.QueryRow(r.Context(), selectPasswordQueryString, userID).Scan(&username, &hashedPassword); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if !s.verifyCurrentPassword(w, r, username, hashedPassword, requestStruct.CurrentPassword, lockouts) {
+			return
+		}
+
+		newHashedPassword, err := s.hashPassword(r.Context(), requestStruct.NewPassword)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), updatePasswordQueryString, userID, newHashedPassword); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Anyone else who knew the old password gets signed out
+		if err := revokeOtherSessions(r.Context(), tx, userID, sessionIDFromContext(r.Context())); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) requestPasswordReset() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_request_password_reset_duration_seconds",
+		Help: "Histogram for requestPasswordReset endpoint latency",
+	})
+
+	type requestPasswordResetRequest struct {
+		Email string `json:"email"`
+	}
+
+	const (
+		selectUserByEmailQueryString = "SELECT id, username, email FROM chat_user WHERE lower(email) = lower($1)"
+	)
+
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_password_reset_lockouts_total",
+		Help: "Counter for password resets that were throttled after too many requests",
+	}, []string{"scope"})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct requestPasswordResetRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := validate(field("email", requestStruct.Email, required, emailAddress)); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		attemptKeys := passwordResetAttemptKeys(requestStruct.Email, clientFromRequest(r).IP)
+		retryAfter, err := s.loginRetryAfter(r.Context(), attemptKeys)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			s.writeError(w, r, errTooManyRequests("Too many password resets, try again later"))
+			return
+		}
+		if _, err := s.recordLoginFailure(r.Context(), attemptKeys, lockouts); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// The response is the same whether or not the email belongs to anyone
+		// so that this can't be used to find out who has an account
+		var userID int64
+		var username, email string
+		err = s.db.QueryRow(r.Context(), selectUserByEmailQueryString, requestStruct.Email).Scan(&userID, &username, &email)
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Sending takes long enough that waiting for it would also give away
+		// that the account exists
+		go s.sendPasswordReset(userID, username, email)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// sendPasswordReset creates a password reset token for userID and emails it
+// to them. It runs after the request that asked for it has been answered, so
+// failures are only logged.
+func (s *Server) sendPasswordReset(userID int64, username, email string) {
+	const (
+		insertPasswordResetQueryString = `
+INSERT INTO password_reset (user_id, token_hash, expires_at)
+	VALUES ($1, $2, $3)
+`
+
+		passwordResetBody = `Hi %s,
+
+Someone asked to reset the password for your chat account. If it was you,
+use this token to choose a new password within the next %d minutes:
+
+%s
+
+If it wasn't you, you can ignore this email and your password won't change.
+`
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), passwordResetSendTimeout)
+	defer cancel()
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		s.logger.Error().Err(err).Int64("user", userID).Msg("Couldn't create password reset token")
+		return
+	}
+
+	expiresAt := time.Now().Add(passwordResetLifetime)
+	if _, err := s.db.Exec(ctx, insertPasswordResetQueryString, userID, tokenHash, expiresAt); err != nil {
+		s.logger.Error().Err(err).Int64("user", userID).Msg("Couldn't store password reset token")
+		return
+	}
+
+	err = s.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Reset your chat password",
+		Body:    fmt.Sprintf(passwordResetBody, username, int(passwordResetLifetime.Minutes()), token),
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Int64("user", userID).Msg("Couldn't send password reset email")
+	}
+}
+
+func (s *Server) confirmPasswordReset() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_confirm_password_reset_duration_seconds",
+		Help: "Histogram for confirmPasswordReset endpoint latency",
+	})
+
+	type confirmPasswordResetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	const (
+		selectPasswordResetQueryString = `
+SELECT user_id
+	FROM password_reset
+	WHERE token_hash = $1
+		AND expires_at > now()
+		AND used_at IS NULL
+	FOR UPDATE
+`
+
+		updatePasswordQueryString = "UPDATE chat_user SET password = $2 WHERE id = $1"
+
+		// Every outstanding reset for the user is spent along with the one
+		// that was used
+		usePasswordResetsQueryString = "UPDATE password_reset SET used_at = now() WHERE user_id = $1 AND used_at IS NULL"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct confirmPasswordResetRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("token", requestStruct.Token, required),
+			field("password", requestStruct.Password, required, maxBytes(maxPasswordBytes), strongPassword),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var userID int64
+		err = tx.QueryRow(r.Context(), selectPasswordResetQueryString, hashToken(requestStruct.Token)).Scan(&userID)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errUnprocessable("Reset token is invalid, expired or already used", nil))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		hashedPassword, err := s.hashPassword(r.Context(), requestStruct.Password)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), updatePasswordQueryString, userID, hashedPassword); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), usePasswordResetsQueryString, userID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Whoever had the account before the reset is signed out everywhere
+		if err := revokeOtherSessions(r.Context(), tx, userID, 0); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
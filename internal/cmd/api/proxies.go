@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses the CIDRs of the reverse proxies whose
+// X-Forwarded-For headers are believed. A bare IP is a network of one.
+// Entries may also be comma separated, since that's how they end up when they
+// come from a single environment variable.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		for _, cidr := range strings.Split(entry, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, fmt.Errorf("trusted proxy %q isn't an IP or CIDR", cidr)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip = ip.To4()
+					bits = 8 * net.IPv4len
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q isn't an IP or CIDR", cidr)
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// isTrustedProxy is whether ip belongs to one of the trusted proxies
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP replaces the request's remote address with the client's, as
+// reported by the trusted proxies in front of the server.
+//
+// Every proxy appends the address that it got the request from to
+// X-Forwarded-For, so only the hops on the right were written by proxies that
+// are trusted. Walking from the right, the first hop that isn't a trusted
+// proxy is the client. Anything to the left of it could've been sent by the
+// client, so it's ignored, as is X-Real-IP.
+func realIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			// Headers from anyone other than a trusted proxy are ignored
+			peer := net.ParseIP(host)
+			if peer == nil || !isTrustedProxy(trusted, peer) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var hops []string
+			for _, header := range r.Header.Values("X-Forwarded-For") {
+				hops = append(hops, strings.Split(header, ",")...)
+			}
+
+			client := peer
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := net.ParseIP(strings.TrimSpace(hops[i]))
+				if hop == nil {
+					// The chain is garbled past here, so the last proxy that
+					// could be trusted is as close to the client as we get
+					break
+				}
+				client = hop
+				if !isTrustedProxy(trusted, hop) {
+					break
+				}
+			}
+
+			r.RemoteAddr = client.String()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reactionsChannel is the postgres NOTIFY channel that reactions being added
+// and removed are announced on
+const reactionsChannel = "chat_reactions"
+
+// reactionSummary is every reaction to a message with the same emoji
+type reactionSummary struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+
+	// Reacted is whether the caller is one of the users who reacted
+	Reacted bool `json:"reacted"`
+}
+
+// reactionNotification is the payload of a NOTIFY on reactionsChannel
+type reactionNotification struct {
+	Message      int64  `json:"message"`
+	Conversation int64  `json:"conversation"`
+	User         int64  `json:"user"`
+	Emoji        string `json:"emoji"`
+
+	// Reacted is true when the reaction was added and false when it was
+	// removed
+	Reacted bool `json:"reacted"`
+}
+
+// reactionEvent is what live subscribers receive when a reaction is added or
+// removed. Event is always "reaction" so that WebSocket clients can tell it
+// apart from messages.
+type reactionEvent struct {
+	Event string `json:"event"`
+	reactionNotification
+}
+
+const (
+	// selectReactionsQueryString aggregates the reactions to every message in
+	// $1 for the viewer $2. Emoji are in the order that they were first used.
+	selectReactionsQueryString = `
+SELECT message_id, emoji, count(*), bool_or(user_id = $2)
+	FROM message_reaction
+	WHERE message_id = ANY($1)
+	GROUP BY message_id, emoji
+	ORDER BY message_id, min(created_at), emoji
+`
+
+	// messageReactionsQueryString is selectReactionsQueryString for a single
+	// message
+	messageReactionsQueryString = `
+SELECT emoji, count(*), bool_or(user_id = $2)
+	FROM message_reaction
+	WHERE message_id = $1
+	GROUP BY emoji
+	ORDER BY min(created_at), emoji
+`
+)
+
+// loadReactions fills in the reactions to every message as seen by viewerID
+func (s *Server) loadReactions(ctx context.Context, viewerID int64, messages []messageResponse) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*messageResponse, len(messages))
+	messageIDs := make([]int64, 0, len(messages))
+	for i := range messages {
+		byID[messages[i].ID] = &messages[i]
+		messageIDs = append(messageIDs, messages[i].ID)
+	}
+
+	rows, err := s.db.Query(ctx, selectReactionsQueryString, messageIDs, viewerID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var reaction reactionSummary
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.Reacted); err != nil {
+			return err
+		}
+		message := byID[messageID]
+		message.Reactions = append(message.Reactions, reaction)
+	}
+	return rows.Err()
+}
+
+// messageReactions returns the reactions to a single message as seen by
+// viewerID
+func messageReactions(ctx context.Context, q querier, messageID int64, viewerID int64) ([]reactionSummary, error) {
+	rows, err := q.Query(ctx, messageReactionsQueryString, messageID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []reactionSummary{}
+	for rows.Next() {
+		var reaction reactionSummary
+		if err := rows.Scan(&reaction.Emoji, &reaction.Count, &reaction.Reacted); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// notifyReaction queues a notification for every replica's listener, which
+// postgres only sends once tx commits
+func notifyReaction(ctx context.Context, tx pgx.Tx, n reactionNotification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, notifyQueryString, reactionsChannel, string(payload))
+	return err
+}
+
+func (s *Server) addReaction() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_add_reaction_duration_seconds",
+		Help: "Histogram for addReaction endpoint latency",
+	})
+
+	type addReactionRequest struct {
+		Emoji string `json:"emoji"`
+	}
+
+	type addReactionResponse struct {
+		Reactions []reactionSummary `json:"reactions"`
+	}
+
+	const (
+		// Sharing the lock with other reactions keeps them from landing on a
+		// message while it's being deleted for everyone
+		selectMessageQueryString = "SELECT deleted_at IS NOT NULL FROM message WHERE id = $1 FOR SHARE"
+
+		insertReactionQueryString = `
+INSERT INTO message_reaction (message_id, user_id, emoji)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct addReactionRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("emoji", requestStruct.Emoji, required, maxBytes(maxEmojiBytes), emoji),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		messageID := messageIDFromContext(r.Context())
+		userID := userIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var deleted bool
+		err = tx.QueryRow(r.Context(), selectMessageQueryString, messageID).Scan(&deleted)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if deleted {
+			s.writeError(w, r, errConflict("Deleted messages can't be reacted to", nil))
+			return
+		}
+
+		tag, err := tx.Exec(r.Context(), insertReactionQueryString, messageID, userID, requestStruct.Emoji)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Reacting again with the same emoji doesn't change anything
+		status := http.StatusOK
+		if tag.RowsAffected() > 0 {
+			status = http.StatusCreated
+			err := notifyReaction(r.Context(), tx, reactionNotification{
+				Message:      messageID,
+				Conversation: conversationIDFromContext(r.Context()),
+				User:         userID,
+				Emoji:        requestStruct.Emoji,
+				Reacted:      true,
+			})
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+		}
+
+		reactions, err := messageReactions(r.Context(), tx, messageID, userID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, status, addReactionResponse{Reactions: reactions})
+	}
+}
+
+func (s *Server) removeReaction() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_remove_reaction_duration_seconds",
+		Help: "Histogram for removeReaction endpoint latency",
+	})
+
+	const (
+		deleteReactionQueryString = "DELETE FROM message_reaction WHERE message_id = $1 AND user_id = $2 AND emoji = $3"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Emoji always end up percent encoded in the path
+		reaction, err := url.PathUnescape(chi.URLParam(r, "emoji"))
+		if err != nil {
+			s.writeError(w, r, errNotFound("Reaction not found"))
+			return
+		}
+
+		messageID := messageIDFromContext(r.Context())
+		userID := userIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		tag, err := tx.Exec(r.Context(), deleteReactionQueryString, messageID, userID, reaction)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			s.writeError(w, r, errNotFound("Reaction not found"))
+			return
+		}
+
+		err = notifyReaction(r.Context(), tx, reactionNotification{
+			Message:      messageID,
+			Conversation: conversationIDFromContext(r.Context()),
+			User:         userID,
+			Emoji:        reaction,
+			Reacted:      false,
+		})
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readStateResponse is how far a user has read in a conversation
+type readStateResponse struct {
+	Conversation int64 `json:"conversation"`
+
+	// LastRead is the newest message that the user has read
+	LastRead int64 `json:"last_read"`
+
+	// Unread is how many messages from other members are newer than
+	// LastRead, up to maxUnreadCount
+	Unread int64 `json:"unread"`
+
+	// Truncated is set when there are more than maxUnreadCount unread
+	// messages, so Unread is only a lower bound
+	Truncated bool `json:"truncated"`
+}
+
+// maxUnreadCount is where unread counts stop. Counts are worked out when
+// they're read, from the (conversation_id, id) index, so that sending a
+// message never has to touch every member. The cap bounds what a conversation
+// that's never read costs to count, and clients show anything past it as
+// "1000+".
+const maxUnreadCount = 1000
+
+// unreadCountLimit is how far countUnreadSubquery counts, one past the cap so
+// that a truncated count can be told apart from an exact one
+const unreadCountLimit = maxUnreadCount + 1
+
+// setUnread fills in the unread count from what countUnreadSubquery found
+func (state *readStateResponse) setUnread(count int64) {
+	state.Unread = count
+	state.Truncated = count > maxUnreadCount
+	if state.Truncated {
+		state.Unread = maxUnreadCount
+	}
+}
+
+// countUnreadSubquery counts, up to $2, the messages in the conversation of
+// member that user $1 hasn't read. Their own messages don't count, and
+// neither do ones that were deleted for everyone or hidden from them.
+const countUnreadSubquery = `(
+	SELECT count(*)
+		FROM (
+			SELECT 1
+				FROM message
+				WHERE message.conversation_id = member.conversation_id
+					AND message.id > member.last_read_id
+					AND message.sender_id <> $1
+					AND message.deleted_at IS NULL
+					AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $1)
+				LIMIT $2
+		) AS unread
+)`
+
+// selectReadByQueryString selects every member other than the sender who has
+// read each message in $1
+const selectReadByQueryString = `
+SELECT message.id, array_agg(conversation_member.user_id ORDER BY conversation_member.user_id)
+	FROM message
+		join conversation_member ON conversation_member.conversation_id = message.conversation_id
+	WHERE message.id = ANY($1)
+		AND conversation_member.last_read_id >= message.id
+		AND conversation_member.user_id <> message.sender_id
+	GROUP BY message.id
+`
+
+// loadReadBy fills in who has read every message
+func (s *Server) loadReadBy(ctx context.Context, messages []messageResponse) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*messageResponse, len(messages))
+	messageIDs := make([]int64, 0, len(messages))
+	for i := range messages {
+		byID[messages[i].ID] = &messages[i]
+		messageIDs = append(messageIDs, messages[i].ID)
+	}
+
+	rows, err := s.db.Query(ctx, selectReadByQueryString, messageIDs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var readBy []int64
+		if err := rows.Scan(&messageID, &readBy); err != nil {
+			return err
+		}
+		byID[messageID].ReadBy = readBy
+	}
+	return rows.Err()
+}
+
+func (s *Server) markRead() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_mark_read_duration_seconds",
+		Help: "Histogram for markRead endpoint latency",
+	})
+
+	type markReadRequest struct {
+		Conversation int64 `json:"conversation"`
+
+		// Message is the newest message that was read
+		Message int64 `json:"message"`
+	}
+
+	const (
+		isMemberQueryString = "SELECT EXISTS (SELECT 1 FROM conversation_member WHERE conversation_id = $1 AND user_id = $2)"
+
+		messageInConversationQueryString = "SELECT EXISTS (SELECT 1 FROM message WHERE id = $1 AND conversation_id = $2)"
+
+		// The watermark never moves backward
+		updateReadStateQueryString = `
+WITH member AS (
+	UPDATE conversation_member
+		SET last_read_id = greatest(last_read_id, $3)
+		WHERE conversation_id = $4
+			AND user_id = $1
+		RETURNING conversation_id, last_read_id
+)
+SELECT last_read_id, ` + countUnreadSubquery + `
+	FROM member
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct markReadRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("conversation", requestStruct.Conversation, required),
+			field("message", requestStruct.Message, required),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+		var isMember bool
+		if err := s.db.QueryRow(r.Context(), isMemberQueryString, requestStruct.Conversation, userID).Scan(&isMember); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if !isMember {
+			s.writeError(w, r, errNotFound("Conversation not found"))
+			return
+		}
+
+		var inConversation bool
+		if err := s.db.QueryRow(r.Context(), messageInConversationQueryString, requestStruct.Message, requestStruct.Conversation).Scan(&inConversation); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		err = validate(
+			field("message", requestStruct.Message, ensure(inConversation, "must be a message in the conversation")),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		state := readStateResponse{Conversation: requestStruct.Conversation}
+		var unread int64
+		err = s.db.QueryRow(r.Context(), updateReadStateQueryString, userID, unreadCountLimit, requestStruct.Message, requestStruct.Conversation).
+			Scan(&state.LastRead, &unread)
+		if err == pgx.ErrNoRows {
+			// The caller left the conversation since we looked
+			s.writeError(w, r, errNotFound("Conversation not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		state.setUnread(unread)
+
+		s.writeJSON(w, http.StatusOK, state)
+	}
+}
+
+func (s *Server) listUnread() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_unread_duration_seconds",
+		Help: "Histogram for listUnread endpoint latency",
+	})
+
+	type listUnreadResponse struct {
+		Conversations []readStateResponse `json:"conversations"`
+
+		// Total is the sum of every conversation's unread count
+		Total int64 `json:"total"`
+
+		// Truncated is set when any conversation's count was, so Total is
+		// only a lower bound
+		Truncated bool `json:"truncated"`
+	}
+
+	const (
+		selectReadStatesQueryString = `
+SELECT member.conversation_id, member.last_read_id, ` + countUnreadSubquery + `
+	FROM conversation_member AS member
+	WHERE member.user_id = $1
+	ORDER BY member.conversation_id
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		rows, err := s.db.Query(r.Context(), selectReadStatesQueryString, userIDFromContext(r.Context()), unreadCountLimit)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		response := listUnreadResponse{Conversations: []readStateResponse{}}
+		for rows.Next() {
+			var state readStateResponse
+			var unread int64
+			if err := rows.Scan(&state.Conversation, &state.LastRead, &unread); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			state.setUnread(unread)
+			response.Conversations = append(response.Conversations, state)
+			response.Total += state.Unread
+			response.Truncated = response.Truncated || state.Truncated
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	}
+}
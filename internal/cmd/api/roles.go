@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	// roleUser is what every user starts out as
+	roleUser = "user"
+
+	// roleModerator can clean up after other users
+	roleModerator = "moderator"
+
+	// roleAdmin can do everything
+	roleAdmin = "admin"
+)
+
+// permission is something that only some roles are allowed to do
+type permission string
+
+const (
+	// permissionListUsers allows listing every user
+	permissionListUsers permission = "users:list"
+
+	// permissionManageUsers allows disabling and enabling users and changing
+	// their roles
+	permissionManageUsers permission = "users:manage"
+
+	// permissionDeleteMessages allows deleting anyone's messages
+	permissionDeleteMessages permission = "messages:delete"
+)
+
+// rolePermissions is what each role is allowed to do on top of what every
+// user can do
+var rolePermissions = map[string][]permission{
+	roleUser:      {},
+	roleModerator: {permissionDeleteMessages},
+	roleAdmin:     {permissionListUsers, permissionManageUsers, permissionDeleteMessages},
+}
+
+// roleContextKey is where authRequired stores the authenticated user's role
+const roleContextKey contextKey = "role"
+
+// roleFromContext returns the authenticated user's role that was placed into
+// the request context by authRequired
+func roleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleContextKey).(string)
+	return role
+}
+
+// roleHasPermission reports whether role is allowed to do p
+func roleHasPermission(role string, p permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// userStatus looks up a user's role and whether they were disabled
+func (s *Server) userStatus(ctx context.Context, userID int64) (string, bool, error) {
+	const selectUserStatusQueryString = "SELECT role, disabled_at IS NOT NULL FROM chat_user WHERE id = $1"
+
+	var role string
+	var disabled bool
+	err := s.db.QueryRow(ctx, selectUserStatusQueryString, userID).Scan(&role, &disabled)
+	return role, disabled, err
+}
+
+// permissionRequired rejects requests from users whose role isn't allowed to
+// do p. It has to come after authRequired.
+func (s *Server) permissionRequired(p permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !roleHasPermission(roleFromContext(r.Context()), p) {
+				s.writeError(w, r, errForbidden("You don't have permission to do this"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,34 +1,152 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/abatilo/chat/internal/password"
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/prometheus/client_golang/prometheus"
-	"golang.org/x/crypto/bcrypt"
 )
 
+type contextKey string
+
+// userIDContextKey is where authRequired stores the authenticated user's ID
+const userIDContextKey contextKey = "userID"
+
+// sessionIDContextKey is where authRequired stores the ID of the session
+// that the request's token belongs to
+const sessionIDContextKey contextKey = "sessionID"
+
+// apiKeyIDContextKey is where authRequired stores the ID of the API key that
+// authenticated the request, if it was one
+const apiKeyIDContextKey contextKey = "apiKeyID"
+
+// userIDFromContext returns the authenticated user's ID that was placed into
+// the request context by authRequired
+func userIDFromContext(ctx context.Context) int64 {
+	userID, _ := ctx.Value(userIDContextKey).(int64)
+	return userID
+}
+
+// sessionIDFromContext returns the ID of the authenticated session that was
+// placed into the request context by authRequired
+func sessionIDFromContext(ctx context.Context) int64 {
+	sessionID, _ := ctx.Value(sessionIDContextKey).(int64)
+	return sessionID
+}
+
+// apiKeyIDFromContext returns the ID of the API key that was placed into the
+// request context by authRequired
+func apiKeyIDFromContext(ctx context.Context) int64 {
+	apiKeyID, _ := ctx.Value(apiKeyIDContextKey).(int64)
+	return apiKeyID
+}
+
 // BEGIN registerRoutes
 
 func (s *Server) registerRoutes() {
-	// Register session middleware
-	s.router.Use(s.sessionManager.LoadAndSave)
-
-	// Application routes
-	s.router.Get("/", s.root())
-	s.router.Get("/check", s.ping())
-	s.router.Post("/users", s.createUser())
-	s.router.Post("/login", s.login())
-	s.router.Route("/messages", func(r chi.Router) {
-		r.Use(s.authRequired())
-		r.Post("/", s.createMessage())
-		r.Get("/", s.listMessages())
+	// Client IPs are only as trustworthy as whatever set these headers
+	if len(s.trustedProxies) > 0 {
+		s.router.Use(realIP(s.trustedProxies))
+	}
+
+	// Streaming routes hold their response open for as long as the client is
+	// connected, so they stay out of the session middleware. LoadAndSave would
+	// buffer the entire response until the stream ends. Blob downloads are
+	// streamed too.
+	s.router.Group(func(r chi.Router) {
+		r.With(s.authRequired(scopeMessagesRead)).Get("/messages/stream", s.streamMessages())
+		r.With(s.authRequired(scopeMessagesRead)).Get("/messages/events", s.messageEvents())
+		if s.blobStore != nil {
+			r.With(s.authRequired()).Get("/blobs/{blobID}", s.downloadBlob())
+		}
+	})
+
+	s.router.Group(func(r chi.Router) {
+		// Register session middleware
+		r.Use(s.sessionManager.LoadAndSave)
+
+		// Application routes
+		r.Get("/", s.root())
+		r.Get("/check", s.ping())
+		r.Post("/users", s.createUser())
+		r.With(s.authRequired()).Put("/users/me/password", s.changePassword())
+		r.Route("/users/me/2fa", func(r chi.Router) {
+			r.Use(s.authRequired())
+			r.Post("/", s.enrollTwoFactor())
+			r.Post("/verify", s.verifyTwoFactor())
+			r.Delete("/", s.disableTwoFactor())
+		})
+		// Password resets are only offered when there's a way to email the
+		// reset token
+		if s.mailer != nil {
+			r.Post("/password-reset", s.requestPasswordReset())
+			r.Post("/password-reset/confirm", s.confirmPasswordReset())
+		}
+		r.Post("/login", s.login())
+		r.Post("/login/2fa", s.completeTwoFactorLogin())
+		r.Post("/token/refresh", s.refreshToken())
+		if s.oidcProvider != nil {
+			r.Get("/auth/oidc/login", s.oidcLogin())
+			r.Get("/auth/oidc/callback", s.oidcCallback())
+		}
+		r.With(s.authRequired()).Post("/logout", s.logout())
+		r.Route("/sessions", func(r chi.Router) {
+			r.Use(s.authRequired())
+			r.Get("/", s.listSessions())
+			r.Delete("/{sessionID}", s.revokeSession())
+		})
+		r.Route("/service-accounts", func(r chi.Router) {
+			r.Use(s.authRequired())
+			r.Post("/", s.createServiceAccount())
+			r.Get("/", s.listServiceAccounts())
+			r.Route("/{serviceAccountID}/keys", func(r chi.Router) {
+				r.Use(s.serviceAccountOwnerRequired())
+				r.Post("/", s.createAPIKey())
+				r.Get("/", s.listAPIKeys())
+				r.Delete("/{keyID}", s.revokeAPIKey())
+			})
+		})
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.authRequired())
+			r.With(s.permissionRequired(permissionListUsers)).Get("/users", s.listUsers())
+			r.With(s.permissionRequired(permissionManageUsers)).Patch("/users/{userID}", s.updateUser())
+			r.With(s.permissionRequired(permissionDeleteMessages)).Delete("/messages/{messageID}", s.deleteAnyMessage())
+		})
+		r.With(s.authRequired(scopeMessagesRead)).Get("/unread", s.listUnread())
+		r.Route("/messages", func(r chi.Router) {
+			r.With(s.authRequired(scopeMessagesWrite)).Post("/", s.createMessage())
+			r.With(s.authRequired(scopeMessagesRead)).Get("/", s.listMessages())
+			r.With(s.authRequired(scopeMessagesWrite)).Post("/read", s.markRead())
+			r.Route("/{messageID}", func(r chi.Router) {
+				r.With(s.authRequired(scopeMessagesWrite), s.messageMemberRequired()).Patch("/", s.editMessage())
+				r.With(s.authRequired(scopeMessagesWrite), s.messageMemberRequired()).Delete("/", s.deleteMessage())
+				r.With(s.authRequired(scopeMessagesRead), s.messageMemberRequired()).Get("/revisions", s.listMessageRevisions())
+				r.With(s.authRequired(scopeMessagesRead), s.messageMemberRequired()).Get("/thread", s.listThread())
+				r.With(s.authRequired(scopeMessagesWrite), s.messageMemberRequired()).Post("/reactions", s.addReaction())
+				r.With(s.authRequired(scopeMessagesWrite), s.messageMemberRequired()).Delete("/reactions/{emoji}", s.removeReaction())
+			})
+		})
+		if s.blobStore != nil {
+			r.With(s.authRequired()).Post("/blobs", s.uploadBlob())
+		}
+		r.Route("/conversations", func(r chi.Router) {
+			r.With(s.authRequired()).Post("/", s.createConversation())
+			r.With(s.authRequired()).Get("/", s.listConversations())
+			r.Route("/{conversationID}", func(r chi.Router) {
+				r.With(s.authRequired(), s.conversationMemberRequired()).Post("/members", s.addConversationMember())
+				r.With(s.authRequired(), s.conversationMemberRequired()).Delete("/members/{userID}", s.removeConversationMember())
+				r.With(s.authRequired(scopeMessagesWrite), s.conversationMemberRequired()).Post("/messages", s.createConversationMessage())
+				r.With(s.authRequired(scopeMessagesRead), s.conversationMemberRequired()).Get("/messages", s.listConversationMessages())
+			})
+		})
 	})
 }
 
@@ -92,6 +210,9 @@ func (s *Server) createUser() http.HandlerFunc {
 	type createUserRequest struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+
+		// Email is optional, but it's the only way to reset a forgotten password
+		Email string `json:"email"`
 	}
 
 	type createUserResponse struct {
@@ -99,32 +220,73 @@ func (s *Server) createUser() http.HandlerFunc {
 	}
 
 	const (
-		insertQueryString = "INSERT INTO chat_user (username, password) VALUES ($1, $2) returning id"
+		insertQueryString = "INSERT INTO chat_user (username, password, email) VALUES ($1, $2, nullif($3, '')) returning id"
+
+		// usernameUniqueConstraint is the name postgres gave to the UNIQUE
+		// constraint on chat_user.username
+		usernameUniqueConstraint = "chat_user_username_key"
+
+		// emailUniqueIndex is the unique index on lower(chat_user.email)
+		emailUniqueIndex = "chat_user_email_key"
 	)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
 
 		// Parse request
 		var requestStruct createUserRequest
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		json.Unmarshal(bodyBytes, &requestStruct)
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		rules := []fieldRules{
+			field("username", requestStruct.Username, required, matches(usernamePattern, "must be 3 to 32 letters, digits, '_', '.' or '-'")),
+			field("password", requestStruct.Password, required, maxBytes(maxPasswordBytes), strongPassword),
+		}
+		if requestStruct.Email != "" {
+			rules = append(rules, field("email", requestStruct.Email, maxLength(maxEmailLength), emailAddress))
+		}
+		if err := validate(rules...); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		hashedPassword, err := s.hashPassword(r.Context(), requestStruct.Password)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
 
 		// Create user in database
 		var userID int64
-		tx, _ := s.db.Begin(r.Context())
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(requestStruct.Password), bcrypt.MinCost)
-		tx.QueryRow(r.Context(), insertQueryString, requestStruct.Username, hashedPassword).Scan(&userID)
-		tx.Commit(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
 
-		// Write out response
-		responseStruct := createUserResponse{ID: int64(userID)}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(responseStruct)
+		err = tx.QueryRow(r.Context(), insertQueryString, requestStruct.Username, hashedPassword, requestStruct.Email).Scan(&userID)
+		if isPGError(err, pgUniqueViolation, usernameUniqueConstraint) {
+			s.writeError(w, r, errConflict("Username is already taken", err))
+			return
+		} else if isPGError(err, pgUniqueViolation, emailUniqueIndex) {
+			s.writeError(w, r, errConflict("Email is already taken", err))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
 
-		duration.Observe(time.Since(startTime).Seconds())
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Write out response
+		s.writeJSON(w, http.StatusCreated, createUserResponse{ID: userID})
 	}
 }
 
@@ -139,55 +301,125 @@ func (s *Server) login() http.HandlerFunc {
 		Password string `json:"password"`
 	}
 
-	type loginResponse struct {
-		ID    int64  `json:"id"`
-		Token string `json:"token"`
-	}
-
 	const (
-		selectPasswordQueryString = "SELECT id, password FROM chat_user WHERE username = $1"
+		// Service accounts only ever authenticate with API keys
+		selectPasswordQueryString = "SELECT id, password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM chat_user WHERE username = $1 AND owner_id IS NULL"
 	)
 
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_login_lockouts_total",
+		Help: "Counter for logins that were locked out after too many failures",
+	}, []string{"scope"})
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
 
 		// Parse request
 		var requestStruct loginRequest
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		json.Unmarshal(bodyBytes, &requestStruct)
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		err := validate(
+			field("username", requestStruct.Username, required),
+			field("password", requestStruct.Password, required, maxBytes(maxPasswordBytes)),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Locked out clients don't even get a password comparison
+		attemptKeys := loginAttemptKeys(requestStruct.Username, clientFromRequest(r).IP)
+		retryAfter, err := s.loginRetryAfter(r.Context(), attemptKeys)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			s.writeError(w, r, errTooManyRequests("Too many failed logins, try again later"))
+			return
+		}
 
 		var userID int64
-		var hashedPassword []byte
-		s.db.QueryRow(r.Context(), selectPasswordQueryString, requestStruct.Username).Scan(&userID, &hashedPassword)
-		err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(requestStruct.Password))
+		var hashedPassword string
+		var twoFactorEnabled, disabled bool
+		err = s.db.QueryRow(r.Context(), selectPasswordQueryString, requestStruct.Username).Scan(&userID, &hashedPassword, &twoFactorEnabled, &disabled)
+		if err == pgx.ErrNoRows {
+			// A missing user falls through to a failed comparison against a
+			// throwaway hash so that both cases look the same to the client
+			hashedPassword = s.missingUserPasswordHash()
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		err = s.verifyPassword(r.Context(), hashedPassword, requestStruct.Password)
+		if err == nil && userID == 0 {
+			err = password.ErrMismatch
+		}
 		if err != nil {
+			retryAfter, err := s.recordLoginFailure(r.Context(), attemptKeys, lockouts)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Couldn't record failed login")
+			}
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			}
+
 			// Do we want to 401? 403?
-			http.Error(w, "Failed to login", http.StatusUnauthorized)
+			s.writeError(w, r, errUnauthorized("Failed to login"))
 			return
 		}
 
-		// Place a session API token into this user's session
-		token := uuid.New()
-		s.sessionManager.Put(r.Context(), "token", token.String())
+		// Only someone who knows the password finds out that it's disabled
+		if disabled {
+			s.writeError(w, r, errForbidden("Account is disabled"))
+			return
+		}
 
-		responseStruct := loginResponse{ID: int64(userID), Token: token.String()}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(responseStruct)
+		// Hashes from before the current policy are upgraded while the
+		// plaintext is at hand
+		if s.passwordHasher.NeedsRehash(hashedPassword) {
+			s.rehashPassword(r.Context(), userID, hashedPassword, requestStruct.Password)
+		}
 
-		duration.Observe(time.Since(startTime).Seconds())
+		// Tokens are only issued by completeTwoFactorLogin once the code is in,
+		// and failures are only forgotten then too. Otherwise getting the
+		// password right again would reset the count of wrong codes.
+		if twoFactorEnabled {
+			s.startTwoFactorChallenge(w, r, userID)
+			return
+		}
+
+		if err := s.clearLoginFailures(r.Context(), userID, requestStruct.Username); err != nil {
+			s.logger.Error().Err(err).Msg("Couldn't clear failed logins")
+		}
+
+		// The tokens work on their own, without the session cookie
+		tokens, err := s.createSession(r.Context(), userID, clientFromRequest(r))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, tokens)
 	}
 }
 
-func (s *Server) authRequired() func(http.Handler) http.Handler {
+// authRequired rejects requests without a valid access token. API keys are
+// only accepted when they were granted every one of scopes, so routes that
+// don't list any are off limits to them. Disabled users are always rejected.
+func (s *Server) authRequired(scopes ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authorizationHeader := r.Header.Get("authorization")
 			if authorizationHeader == "" {
 				// We might want these as 404s. It depends on the expected user experience
-				s.logger.Error().Msg("Missing authorization header")
-				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				s.writeError(w, r, errForbidden("Missing authorization header"))
 				return
 			}
 
@@ -195,14 +427,52 @@ func (s *Server) authRequired() func(http.Handler) http.Handler {
 				authorizationHeader = authorizationHeader[len("bearer "):]
 			}
 
-			token := s.sessionManager.GetString(r.Context(), "token")
+			var sessionID, apiKeyID, userID int64
+			if isAPIKey(authorizationHeader) {
+				var grantedScopes []string
+				var err error
+				apiKeyID, userID, grantedScopes, err = s.authenticateAPIKey(r.Context(), authorizationHeader)
+				if err != nil {
+					s.writeError(w, r, errInternal(err))
+					return
+				}
+				if userID != 0 && (len(scopes) == 0 || !hasScopes(grantedScopes, scopes)) {
+					s.writeError(w, r, errForbidden("API key isn't allowed to do this"))
+					return
+				}
+			}
+
+			// Access tokens are random, so one could start with the API key
+			// prefix too. Those fall through to here.
+			if userID == 0 {
+				var err error
+				sessionID, userID, err = s.authenticateToken(r.Context(), authorizationHeader)
+				if err != nil {
+					s.writeError(w, r, errInternal(err))
+					return
+				}
+			}
+
+			if userID == 0 {
+				s.writeError(w, r, errUnauthorized("Token is invalid, expired or revoked"))
+				return
+			}
 
-			if token == authorizationHeader {
-				next.ServeHTTP(w, r)
-			} else {
-				s.logger.Error().Str("token", token).Str("header", authorizationHeader).Msg("Session token didn't match what's in authorization header")
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			role, disabled, err := s.userStatus(r.Context(), userID)
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if disabled {
+				s.writeError(w, r, errForbidden("Account is disabled"))
+				return
 			}
+
+			ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+			ctx = context.WithValue(ctx, sessionIDContextKey, sessionID)
+			ctx = context.WithValue(ctx, apiKeyIDContextKey, apiKeyID)
+			ctx = context.WithValue(ctx, roleContextKey, role)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
@@ -213,96 +483,89 @@ func (s *Server) createMessage() http.HandlerFunc {
 		Help: "Histogram for createMessage endpoint latency",
 	})
 
-	type content struct {
-		Type string `json:"type"`
-		// Type == "text"
-		Text string `json:"text,omitempty"`
-
-		// Type == "image"
-		Height uint64 `json:"height,omitempty"`
-		Width  uint64 `json:"width,omitempty"`
-
-		// Type == "video"
-		Source string `json:"source,omitempty"`
-
-		// Type == "image" || Type == "video"
-		URL string `json:"url,omitempty"`
-	}
-
 	type createMessageRequest struct {
-		Sender    int64   `json:"sender"`
-		Recipient int64   `json:"recipient"`
-		Content   content `json:"content"`
-	}
-
-	type createMessageReponse struct {
-		ID        int64  `json:"id"`
-		Timestamp string `json:"timestamp"`
+		// Sender is optional and only kept for backwards compatibility. The
+		// sender is always the authenticated user.
+		Sender    int64           `json:"sender"`
+		Recipient int64           `json:"recipient"`
+		Content   json.RawMessage `json:"content"`
+		// ReplyTo is the message that this one replies to, if any
+		ReplyTo *int64 `json:"reply_to"`
 	}
 
-	const (
-		createMessageQueryString = `
-INSERT INTO message (sender_id, recipient_id, message_type_id)
-	SELECT $1, $2, message_type.id
-		FROM message_type
-		WHERE message_type.name = $3
-	RETURNING id, created_at
-`
-		createTextMessageQueryString  = "INSERT INTO text_message (message_id, text) VALUES ($1, $2)"
-		createImageMessageQueryString = "INSERT INTO image_message (message_id, url, width, height) VALUES ($1, $2, $3, $4)"
-		createVideoMessageQueryString = `
-INSERT INTO video_message (message_id, url, source)
-	SELECT $1, $2, video_source.id
-	FROM video_source
-	WHERE video_source.name = $3
-`
-	)
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
 
 		// Parse request
 		var requestStruct createMessageRequest
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		json.Unmarshal(bodyBytes, &requestStruct)
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		senderID := userIDFromContext(r.Context())
+		if requestStruct.Sender != 0 && requestStruct.Sender != senderID {
+			s.writeError(w, r, errForbidden("Sender must be the authenticated user"))
+			return
+		}
 
-		if requestStruct.Content.Width == 0 {
-			requestStruct.Content.Width = 64
+		recipientExists, err := s.userExists(r.Context(), requestStruct.Recipient)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
 		}
-		if requestStruct.Content.Height == 0 {
-			requestStruct.Content.Height = 64
+
+		contentType, content, contentRules, err := s.contentTypes.parseContent("content.", requestStruct.Content)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
 		}
 
-		tx, _ := s.db.Begin(r.Context())
+		rules := []fieldRules{
+			field("recipient", requestStruct.Recipient, required, ensure(recipientExists, "does not exist")),
+		}
+		if err := validate(append(rules, contentRules...)...); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
 
-		var messageID int64
-		var createdAt time.Time
-		tx.QueryRow(r.Context(),
-			createMessageQueryString,
-			requestStruct.Sender,
-			requestStruct.Recipient,
-			requestStruct.Content.Type).Scan(&messageID, &createdAt)
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
 
-		if requestStruct.Content.Type == "text" {
-			tx.Exec(r.Context(), createTextMessageQueryString, messageID, requestStruct.Content.Text)
-		} else if requestStruct.Content.Type == "image" {
-			tx.Exec(r.Context(), createImageMessageQueryString, messageID, requestStruct.Content.URL, requestStruct.Content.Width, requestStruct.Content.Height)
-		} else if requestStruct.Content.Type == "video" {
-			tx.Exec(r.Context(), createVideoMessageQueryString, messageID, requestStruct.Content.URL, requestStruct.Content.Source)
+		// Direct messages live in an implicit two person conversation
+		conversationID, err := directConversation(r.Context(), tx, senderID, requestStruct.Recipient)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
 		}
 
-		tx.Commit(r.Context())
-		responseStruct := createMessageReponse{
-			ID:        messageID,
-			Timestamp: createdAt.UTC().Format(time.RFC3339),
+		messageID, createdAt, err := insertMessage(r.Context(), tx, newMessage{
+			SenderID:       senderID,
+			ConversationID: conversationID,
+			RecipientID:    &requestStruct.Recipient,
+			ContentType:    contentType,
+			Content:        content,
+			ReplyToID:      requestStruct.ReplyTo,
+		})
+		if err != nil {
+			s.writeError(w, r, err)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(responseStruct)
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
 
-		duration.Observe(time.Since(startTime).Seconds())
+		s.writeJSON(w, http.StatusCreated, createMessageResponse{
+			ID:        messageID,
+			Timestamp: createdAt.UTC().Format(time.RFC3339),
+		})
 	}
 }
 
@@ -312,116 +575,34 @@ func (s *Server) listMessages() http.HandlerFunc {
 		Help: "Histogram for listMessages endpoint latency",
 	})
 
-	type listMessagesRequest struct {
-		Recipient int64 `json:"recipient"`
-		Start     int64 `json:"start"`
-		Limit     int64 `json:"limit"`
-	}
-
-	type listMessagesResponseMessage struct {
-		ID        int64                  `json:"id"`
-		Sender    int64                  `json:"sender"`
-		Recipient int64                  `json:"recipient"`
-		Timestamp time.Time              `json:"timestamp"`
-		Content   map[string]interface{} `json:"content"`
-	}
-
-	type listMessagesResponse struct {
-		Messages []listMessagesResponseMessage `json:"messages"`
-	}
-
 	const (
-		listMessagesQueryString = `
-WITH desired_messages AS (
-	SELECT id AS message_id
-	FROM message
-	WHERE recipient_id = $1
-		AND id >= least($2, (SELECT max(id) from message))
-	limit $3
-)
-SELECT message.id,
-			 message.sender_id,
-			 message.recipient_id,
-			 message.created_at,
-			 json_build_object(
-				'type', message_type.name,
-				'text', text_message.text
-			 ) AS content
-	FROM message
-		join desired_messages ON message.id = desired_messages.message_id
-		join message_type ON message.message_type_id = message_type.id
-		join text_message ON message.id = text_message.message_id
-UNION ALL
-SELECT message.id,
-			 message.sender_id,
-			 message.recipient_id,
-			 message.created_at,
-			 json_build_object(
-				'type',     message_type.name,
-				'url',      image_message.url,
-				'width',    image_message.width,
-				'height',   image_message.height
-			 ) AS content
-	FROM message
-		join desired_messages ON message.id = desired_messages.message_id
-		join message_type ON message.message_type_id = message_type.id
-		join image_message ON message.id = image_message.message_id
-UNION ALL
-SELECT message.id,
-			 message.sender_id,
-			 message.recipient_id,
-			 message.created_at,
-			 json_build_object(
-				'type',     message_type.name,
-				'url',      video_message.url,
-				'source',   video_message.source
-			 ) AS content
-	FROM message
-		join desired_messages ON message.id = desired_messages.message_id
-		join message_type ON message.message_type_id = message_type.id
-		join video_message ON message.id = video_message.message_id
-		join video_source ON video_source.id = video_message.source
-ORDER BY id
-`
+		// Only messages that the caller sent or received are ever returned
+		listMessagesFilter = "recipient_id = $4 AND (recipient_id = $3 OR sender_id = $3)"
 	)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
 
-		var requestStruct listMessagesRequest
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		json.Unmarshal(bodyBytes, &requestStruct)
-
-		if requestStruct.Limit == 0 {
-			requestStruct.Limit = 100
-		}
-
-		messages := []listMessagesResponseMessage{}
-		rows, _ := s.db.Query(r.Context(), listMessagesQueryString, requestStruct.Recipient, requestStruct.Start, requestStruct.Limit)
-		for rows.Next() {
-			var messageID int64
-			var senderID int64
-			var recipientID int64
-			var timestamp time.Time
-			var content map[string]interface{}
-
-			rows.Scan(&messageID, &senderID, &recipientID, &timestamp, &content)
-			messages = append(messages, listMessagesResponseMessage{
-				ID:        messageID,
-				Sender:    senderID,
-				Recipient: recipientID,
-				Timestamp: timestamp,
-				Content:   content,
-			})
+		page, err := parseMessagePageRequest(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(listMessagesResponse{
-			Messages: messages,
-		})
+		userID := userIDFromContext(r.Context())
+		recipient, err := int64QueryParam(r, "recipient", userID)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
 
-		duration.Observe(time.Since(startTime).Seconds())
+		messages, err := s.pageMessages(r.Context(), userID, listMessagesFilter, []interface{}{recipient}, page)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, messages)
 	}
 }
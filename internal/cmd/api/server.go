@@ -3,19 +3,26 @@ package api
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
 	"time"
 
 	gosundheit "github.com/AppsFlyer/go-sundheit"
 	"github.com/AppsFlyer/go-sundheit/checks"
 	healthhttp "github.com/AppsFlyer/go-sundheit/http"
+	"github.com/abatilo/chat/internal/mail"
 	"github.com/abatilo/chat/internal/metrics"
+	"github.com/abatilo/chat/internal/oidc"
+	"github.com/abatilo/chat/internal/password"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
@@ -33,16 +40,136 @@ const (
 
 	// FlagPGPassword is the password for accessing the postgres database
 	FlagPGPassword = "pg-password"
+
+	// FlagBlobDir is the directory that uploaded files are stored in
+	FlagBlobDir = "blob-dir"
+
+	// FlagMaxUploadBytes is the largest file that can be uploaded
+	FlagMaxUploadBytes = "max-upload-bytes"
+
+	// FlagPasswordHash is the algorithm that new password hashes use, either
+	// argon2id or bcrypt
+	FlagPasswordHash = "password-hash"
+
+	// FlagBcryptCost is the cost of new bcrypt password hashes
+	FlagBcryptCost = "bcrypt-cost"
+
+	// FlagArgon2Memory is how much memory new argon2id password hashes use,
+	// in KiB
+	FlagArgon2Memory = "argon2-memory"
+
+	// FlagArgon2Time is how many passes new argon2id password hashes make
+	FlagArgon2Time = "argon2-time"
+
+	// FlagArgon2Threads is the parallelism of new argon2id password hashes
+	FlagArgon2Threads = "argon2-threads"
+
+	// FlagMaxPasswordHashes is how many passwords can be hashed or
+	// verified at once. Every argon2id one holds its memory cost until it's
+	// done, so this bounds how much memory they take together.
+	FlagMaxPasswordHashes = "max-password-hashes"
+
+	// FlagTrustedProxies is the CIDRs of the reverse proxies in front of the
+	// server. Client IPs are only taken from X-Forwarded-For when the request
+	// came through one of them.
+	FlagTrustedProxies = "trusted-proxies"
+
+	// FlagSMTPHost is the SMTP server that email is sent through. Password
+	// resets are turned off when it's empty, unless FlagLogMail is set.
+	FlagSMTPHost = "smtp-host"
+
+	// FlagLogMail is whether email is logged instead of sent when there's no
+	// SMTP server, which is only meant for local development
+	FlagLogMail = "log-mail"
+
+	// FlagLogMailBodies is whether logged email includes its body. Bodies hold
+	// secrets like password reset tokens, so this is only for local
+	// development.
+	FlagLogMailBodies = "log-mail-bodies"
+
+	// FlagSMTPPort is the port of the SMTP server
+	FlagSMTPPort = "smtp-port"
+
+	// FlagSMTPUsername is the username for authenticating with the SMTP server
+	FlagSMTPUsername = "smtp-username"
+
+	// FlagSMTPPassword is the password for authenticating with the SMTP server
+	FlagSMTPPassword = "smtp-password"
+
+	// FlagMailFrom is the address that email is sent from
+	FlagMailFrom = "mail-from"
+
+	// FlagAccessTokenLifetime is how long an access token stays valid
+	FlagAccessTokenLifetime = "access-token-lifetime"
+
+	// FlagRefreshTokenLifetime is how long a refresh token stays valid
+	FlagRefreshTokenLifetime = "refresh-token-lifetime"
+
+	// FlagMessageEditWindow is how long after sending a message its sender
+	// can still edit it
+	FlagMessageEditWindow = "message-edit-window"
+
+	// FlagOIDCIssuerURL is the OpenID Connect provider that users can sign in
+	// with. Signing in with a provider is turned off when this is empty.
+	FlagOIDCIssuerURL = "oidc-issuer-url"
+
+	// FlagOIDCClientID is the client ID registered with the OpenID Connect
+	// provider
+	FlagOIDCClientID = "oidc-client-id"
+
+	// FlagOIDCClientSecret is the client secret registered with the OpenID
+	// Connect provider. Public clients leave it empty.
+	FlagOIDCClientSecret = "oidc-client-secret"
+
+	// FlagOIDCRedirectURL is the public URL of the OpenID Connect callback
+	FlagOIDCRedirectURL = "oidc-redirect-url"
+
+	// FlagOIDCScopes are the scopes requested from the OpenID Connect provider
+	FlagOIDCScopes = "oidc-scopes"
 )
 
 // ServerConfig is all configuration for running the application.
 //
 // We use a config struct so that we can statically type and check configuration values
 type ServerConfig struct {
-	Port       int
-	AdminPort  int
-	PGHost     string
-	PGPassword string
+	Port                 int
+	AdminPort            int
+	PGHost               string
+	PGPassword           string
+	BlobDir              string
+	MaxUploadBytes       int64
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+	TrustedProxies       []string
+	PasswordHash         string
+	BcryptCost           int
+	Argon2Memory         uint32
+	Argon2Time           uint32
+	Argon2Threads        uint8
+	MaxPasswordHashes    int
+	SMTPHost             string
+	SMTPPort             int
+	SMTPUsername         string
+	SMTPPassword         string
+	MailFrom             string
+	LogMail              bool
+	LogMailBodies        bool
+	MessageEditWindow    time.Duration
+	OIDCIssuerURL        string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCRedirectURL      string
+	OIDCScopes           []string
+}
+
+// redacted returns a copy of c without any secrets, so that it can be logged
+func (c ServerConfig) redacted() ServerConfig {
+	for _, secret := range []*string{&c.PGPassword, &c.SMTPPassword, &c.OIDCClientSecret} {
+		if *secret != "" {
+			*secret = "[redacted]"
+		}
+	}
+	return c
 }
 
 // PGDB is a generic interface for a pgxpool connection
@@ -54,6 +181,14 @@ type PGDB interface {
 	Ping(context.Context) error
 }
 
+// BlobStore persists the contents of uploaded files. Metadata about each blob
+// lives in postgres.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
 // Server represents the service itself and all of its dependencies.
 //
 // This pattern is heavily based on the following blog post:
@@ -67,6 +202,26 @@ type Server struct {
 	metrics        metrics.Client
 	db             PGDB
 	sessionManager *scs.SessionManager
+	blobStore      BlobStore
+	mailer         mail.Mailer
+	passwordHasher password.Hasher
+	passwordSlots  chan struct{}
+	oidcProvider   *oidc.Provider
+	trustedProxies []*net.IPNet
+	hub            *hub
+	contentTypes   *ContentRegistry
+	listenerPool   *pgxpool.Pool
+	listener       *listener
+	listenerCtx    context.Context
+	stopListener   context.CancelFunc
+	listenerWG     sync.WaitGroup
+	janitor        *janitor
+	janitorCtx     context.Context
+	stopJanitor    context.CancelFunc
+	janitorWG      sync.WaitGroup
+
+	missingUserHashOnce sync.Once
+	missingUserHash     string
 }
 
 // ServerOption lets you functionally control construction of the web server
@@ -85,12 +240,21 @@ func NewServer(cfg *ServerConfig, options ...ServerOption) *Server {
 		},
 		metrics:        &metrics.NoopMetrics{},
 		sessionManager: scs.New(),
+		hub:            newHub(),
+		contentTypes:   DefaultContentTypes(),
+		passwordHasher: password.DefaultArgon2id(),
 	}
 
 	for _, option := range options {
 		option(s)
 	}
 
+	s.passwordSlots = make(chan struct{}, s.maxPasswordHashes())
+
+	s.listener = s.newListener(s.listenerPool)
+	s.listenerCtx, s.stopListener = context.WithCancel(context.Background())
+	s.janitor = s.newJanitor()
+	s.janitorCtx, s.stopJanitor = context.WithCancel(context.Background())
 	s.registerRoutes()
 
 	// We register this last so that we can use things like s.Logger inside of the `createAdminServer`
@@ -101,15 +265,42 @@ func NewServer(cfg *ServerConfig, options ...ServerOption) *Server {
 	return s
 }
 
-// Start starts the main web server and starts a goroutine with the admin
-// server
+// Start starts the main web server and starts goroutines with the admin
+// server, the listener for messages created by other replicas and the janitor
 func (s *Server) Start() error {
+	if err := s.contentTypes.register(context.Background(), s.db); err != nil {
+		s.logger.Error().Err(err).Msg("Couldn't register message content types")
+	}
+
+	if s.listenerPool != nil {
+		s.listenerWG.Add(1)
+		go func() {
+			defer s.listenerWG.Done()
+			s.listener.run(s.listenerCtx)
+		}()
+	} else {
+		s.logger.Warn().Msg("Messages from other replicas won't be delivered because there's no listener pool")
+	}
+
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		s.janitor.run(s.janitorCtx)
+	}()
+
 	go s.adminServer.ListenAndServe()
 	return s.server.ListenAndServe()
 }
 
 // Shutdown calls for a graceful shutdown on the server
 func (s *Server) Shutdown(ctx context.Context) error {
+	// Long lived streams never become idle on their own, so they're told to
+	// disconnect before we wait for in flight requests to finish
+	s.hub.close()
+	s.stopListener()
+	s.listenerWG.Wait()
+	s.stopJanitor()
+	s.janitorWG.Wait()
 	s.adminServer.Shutdown(ctx)
 	return s.server.Shutdown(ctx)
 }
@@ -164,6 +355,14 @@ func WithAdminServer(s *http.Server) ServerOption {
 	}
 }
 
+// WithTrustedProxies sets the reverse proxies whose X-Forwarded-For headers
+// are believed
+func WithTrustedProxies(trusted []*net.IPNet) ServerOption {
+	return func(s *Server) {
+		s.trustedProxies = trusted
+	}
+}
+
 // WithLogger sets the logger of the server
 func WithLogger(logger zerolog.Logger) ServerOption {
 	return func(s *Server) {
@@ -185,6 +384,49 @@ func WithDB(d PGDB) ServerOption {
 	}
 }
 
+// WithListenerPool sets the pool that the listener takes its dedicated
+// connection from
+func WithListenerPool(p *pgxpool.Pool) ServerOption {
+	return func(s *Server) {
+		s.listenerPool = p
+	}
+}
+
+// WithContentTypes overrides the message content types that the server accepts
+func WithContentTypes(registry *ContentRegistry) ServerOption {
+	return func(s *Server) {
+		s.contentTypes = registry
+	}
+}
+
+// WithBlobStore sets where uploaded files are stored
+func WithBlobStore(b BlobStore) ServerOption {
+	return func(s *Server) {
+		s.blobStore = b
+	}
+}
+
+// WithMailer sets how email is sent
+func WithMailer(m mail.Mailer) ServerOption {
+	return func(s *Server) {
+		s.mailer = m
+	}
+}
+
+// WithPasswordHasher sets how new password hashes are made
+func WithPasswordHasher(h password.Hasher) ServerOption {
+	return func(s *Server) {
+		s.passwordHasher = h
+	}
+}
+
+// WithOIDCProvider lets users sign in with an OpenID Connect provider
+func WithOIDCProvider(p *oidc.Provider) ServerOption {
+	return func(s *Server) {
+		s.oidcProvider = p
+	}
+}
+
 // WithSessionManager sets the session manager
 func WithSessionManager(sessionManager *scs.SessionManager) ServerOption {
 	return func(s *Server) {
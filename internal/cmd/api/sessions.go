@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sessionResponse describes one of a user's login sessions
+type sessionResponse struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+
+	// Current is whether this is the session that made the request
+	Current bool `json:"current"`
+}
+
+// revokeSessionQueryString revokes the session $1 if it belongs to the user $2
+const revokeSessionQueryString = `
+UPDATE auth_token
+	SET revoked_at = now()
+	WHERE id = $1
+		AND user_id = $2
+		AND revoked_at IS NULL
+		AND expires_at > now()
+`
+
+func (s *Server) logout() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_logout_duration_seconds",
+		Help: "Histogram for logout endpoint latency",
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		userID := userIDFromContext(r.Context())
+		sessionID := sessionIDFromContext(r.Context())
+		if _, err := s.db.Exec(r.Context(), revokeSessionQueryString, sessionID, userID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		// Clear out anything a cookie based client had in its scs session too
+		if err := s.sessionManager.Destroy(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) listSessions() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_sessions_duration_seconds",
+		Help: "Histogram for listSessions endpoint latency",
+	})
+
+	type listSessionsResponse struct {
+		Sessions []sessionResponse `json:"sessions"`
+	}
+
+	const (
+		selectSessionsQueryString = `
+SELECT id, created_at, last_seen_at, expires_at, ip, user_agent
+	FROM auth_token
+	WHERE user_id = $1
+		AND revoked_at IS NULL
+		AND expires_at > now()
+	ORDER BY last_seen_at DESC
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		sessionID := sessionIDFromContext(r.Context())
+		rows, err := s.db.Query(r.Context(), selectSessionsQueryString, userIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer rows.Close()
+
+		sessions := []sessionResponse{}
+		for rows.Next() {
+			var session sessionResponse
+			if err := rows.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.IP, &session.UserAgent); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			session.Current = session.ID == sessionID
+			sessions = append(sessions, session)
+		}
+		if err := rows.Err(); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, listSessionsResponse{Sessions: sessions})
+	}
+}
+
+func (s *Server) revokeSession() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_revoke_session_duration_seconds",
+		Help: "Histogram for revokeSession endpoint latency",
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		sessionID, err := int64URLParam(r, "sessionID")
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Sessions of other users look the same as sessions that don't exist
+		tag, err := s.db.Exec(r.Context(), revokeSessionQueryString, sessionID, userIDFromContext(r.Context()))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			s.writeError(w, r, errNotFound("Session not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,408 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// streamWriteWait is how long a single write to a stream may take
+	streamWriteWait = 10 * time.Second
+
+	// streamPongWait is how long a WebSocket client may go without answering a ping
+	streamPongWait = 60 * time.Second
+
+	// streamPingPeriod is how often WebSocket clients are pinged. It must be
+	// shorter than streamPongWait.
+	streamPingPeriod = 30 * time.Second
+
+	// eventsHeartbeatPeriod is how often a comment is sent to Server-Sent
+	// Events clients to keep proxies from closing idle connections
+	eventsHeartbeatPeriod = 15 * time.Second
+
+	// eventsRetry is how long, in milliseconds, Server-Sent Events clients
+	// should wait before reconnecting
+	eventsRetry = 3000
+
+	// streamBackfillPageSize is how many messages are read at once when
+	// catching a reconnecting client up
+	streamBackfillPageSize = 500
+
+	// backfillMessagesQueryString selects the messages received by $1 after
+	// the message ID $2 that $1 hasn't hidden
+	backfillMessagesQueryString = `
+SELECT message.id AS message_id
+	FROM message
+		join conversation_member ON conversation_member.conversation_id = message.conversation_id
+	WHERE conversation_member.user_id = $1
+		AND message.sender_id <> $1
+		AND message.id > $2
+		AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $1)
+	ORDER BY message.id
+	LIMIT $3
+`
+
+	// replayMessagesQueryString selects the messages received by $1, up to the
+	// message ID $2, that were created within $3 of it and so might have
+	// committed after it did
+	replayMessagesQueryString = `
+SELECT message.id AS message_id
+	FROM message
+		join conversation_member ON conversation_member.conversation_id = message.conversation_id
+	WHERE conversation_member.user_id = $1
+		AND message.sender_id <> $1
+		AND message.id <= $2
+		AND message.created_at >= (SELECT created_at FROM message WHERE id = $2) - $3::interval
+		AND NOT EXISTS (SELECT 1 FROM message_hide WHERE message_hide.message_id = message.id AND message_hide.user_id = $1)
+	ORDER BY message.id
+`
+)
+
+// afterFromRequest parses the message ID that a reconnecting client has
+// already seen. Zero means the client only wants new messages.
+func afterFromRequest(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	after, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || after < 0 {
+		return 0, errBadRequest("after must be a non-negative message ID", err)
+	}
+	return after, nil
+}
+
+// backfill calls send for every message received by userID after the message
+// ID after, in order, and returns the IDs of the messages that were sent.
+//
+// A message with a lower ID than after can still commit after it, so the
+// messages within messageCommitWindow before after are sent again first.
+// Clients already have most of them and are expected to drop the ones that
+// they've seen by ID.
+func (s *Server) backfill(r *http.Request, userID int64, after int64, send func(messageResponse) error) (map[int64]struct{}, error) {
+	sent := map[int64]struct{}{}
+
+	replayed, err := s.queryMessages(r.Context(), s.db, replayMessagesQueryString, userID, after, messageCommitWindow)
+	if err != nil {
+		return sent, err
+	}
+	for _, message := range replayed {
+		if err := send(message); err != nil {
+			return sent, err
+		}
+		sent[message.ID] = struct{}{}
+	}
+
+	for {
+		messages, err := s.queryMessages(r.Context(), s.db, backfillMessagesQueryString, userID, after, streamBackfillPageSize)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, message := range messages {
+			if err := send(message); err != nil {
+				return sent, err
+			}
+			sent[message.ID] = struct{}{}
+			after = message.ID
+		}
+
+		if len(messages) < streamBackfillPageSize {
+			return sent, nil
+		}
+	}
+}
+
+// stillAuthenticated is whether the session or API key that opened a stream
+// is still good and its user hasn't been disabled. authRequired only checks
+// once, when the stream opens, so streams call this as they go to notice a
+// logout, a revocation or an admin disabling the account.
+func (s *Server) stillAuthenticated(ctx context.Context) (bool, error) {
+	const (
+		sessionValidQueryString = `
+SELECT EXISTS (
+	SELECT 1
+		FROM auth_token
+			join chat_user ON chat_user.id = auth_token.user_id
+		WHERE auth_token.id = $1
+			AND auth_token.revoked_at IS NULL
+			AND auth_token.expires_at > now()
+			AND chat_user.disabled_at IS NULL
+)
+`
+
+		apiKeyValidQueryString = `
+SELECT EXISTS (
+	SELECT 1
+		FROM api_key
+			join chat_user ON chat_user.id = api_key.user_id
+		WHERE api_key.id = $1
+			AND api_key.revoked_at IS NULL
+			AND chat_user.disabled_at IS NULL
+)
+`
+	)
+
+	query, id := sessionValidQueryString, sessionIDFromContext(ctx)
+	if apiKeyID := apiKeyIDFromContext(ctx); apiKeyID != 0 {
+		query, id = apiKeyValidQueryString, apiKeyID
+	}
+
+	var valid bool
+	err := s.db.QueryRow(ctx, query, id).Scan(&valid)
+	return valid, err
+}
+
+func (s *Server) streamMessages() http.HandlerFunc {
+	connections := s.metrics.NewCounter(prometheus.CounterOpts{
+		Name: "chat_stream_messages_connections_total",
+		Help: "Counter for streamMessages WebSocket connections",
+	})
+
+	upgrader := websocket.Upgrader{
+		// Browsers can't set the Authorization header that authRequired demands
+		// on a WebSocket handshake, so a cross site page can't hijack a
+		// session through this endpoint. That lets us allow every origin, the
+		// same way that the CORS configuration does.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := userIDFromContext(r.Context())
+
+		after, err := afterFromRequest(r.URL.Query().Get("after"))
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Subscribe before backfilling so that nothing committed in between
+		// can be missed
+		sub := s.hub.subscribe(userID)
+		defer s.hub.unsubscribe(sub)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already responded with an error
+			s.logger.Info().Err(err).Msg("Couldn't upgrade to a WebSocket connection")
+			return
+		}
+		defer conn.Close()
+		connections.Inc()
+
+		// We never expect anything from the client but we still need to read
+		// so that pongs and close frames are processed
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn.SetReadLimit(512)
+			conn.SetReadDeadline(time.Now().Add(streamPongWait))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(streamPongWait))
+			})
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		send := func(message messageResponse) error {
+			conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			return conn.WriteJSON(message)
+		}
+
+		// Messages that were committed while backfilling can also be waiting
+		// in the subscription, so those are the only ones to skip
+		var backfilled map[int64]struct{}
+		if after > 0 {
+			backfilled, err = s.backfill(r, userID, after, send)
+			if err != nil {
+				s.logger.Error().Err(err).Int64("userID", userID).Msg("Couldn't backfill message stream")
+				return
+			}
+		}
+
+		ticker := time.NewTicker(streamPingPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-sub.events:
+				if !ok {
+					// Either the server is shutting down or we fell behind. The
+					// client is expected to reconnect and resume.
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+						time.Now().Add(streamWriteWait))
+					return
+				}
+
+				switch e.Name {
+				case messageEventName:
+					if _, ok := backfilled[e.ID]; ok {
+						continue
+					}
+					if err := send(e.Data.(messageResponse)); err != nil {
+						return
+					}
+				case reactionEventName:
+					conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+					if err := conn.WriteJSON(e.Data); err != nil {
+						return
+					}
+				}
+			case <-ticker.C:
+				// A database hiccup shouldn't drop every stream at once, so
+				// only a definite answer closes it
+				valid, err := s.stillAuthenticated(r.Context())
+				if err != nil {
+					s.logger.Error().Err(err).Int64("userID", userID).Msg("Couldn't recheck message stream authentication")
+				} else if !valid {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Token is invalid, expired or revoked"),
+						time.Now().Add(streamWriteWait))
+					return
+				}
+
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) messageEvents() http.HandlerFunc {
+	connections := s.metrics.NewCounter(prometheus.CounterOpts{
+		Name: "chat_message_events_connections_total",
+		Help: "Counter for messageEvents Server-Sent Events connections",
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := userIDFromContext(r.Context())
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.writeError(w, r, errInternal(errors.New("response writer doesn't support flushing")))
+			return
+		}
+
+		// EventSource sends Last-Event-ID on its own when it reconnects, but
+		// the first connection can only pass a starting point in the URL
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("after")
+		}
+		after, err := afterFromRequest(lastEventID)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// Subscribe before backfilling so that nothing committed in between
+		// can be missed
+		sub := s.hub.subscribe(userID)
+		defer s.hub.unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Ask nginx style proxies not to buffer the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+		flusher.Flush()
+		connections.Inc()
+
+		send := func(message messageResponse) error {
+			data, err := json.Marshal(message)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", message.ID, messageEventName, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		// Reactions have no id so that Last-Event-ID only ever tracks messages
+		sendReaction := func(reaction interface{}) error {
+			data, err := json.Marshal(reaction)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", reactionEventName, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		// Messages that were committed while backfilling can also be waiting
+		// in the subscription, so those are the only ones to skip
+		var backfilled map[int64]struct{}
+		if after > 0 {
+			backfilled, err = s.backfill(r, userID, after, send)
+			if err != nil {
+				s.logger.Error().Err(err).Int64("userID", userID).Msg("Couldn't backfill message events")
+				return
+			}
+		}
+
+		ticker := time.NewTicker(eventsHeartbeatPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-sub.events:
+				if !ok {
+					// Either the server is shutting down or we fell behind. The
+					// client reconnects on its own with Last-Event-ID.
+					return
+				}
+
+				switch e.Name {
+				case messageEventName:
+					if _, ok := backfilled[e.ID]; ok {
+						continue
+					}
+					if err := send(e.Data.(messageResponse)); err != nil {
+						return
+					}
+				case reactionEventName:
+					if err := sendReaction(e.Data); err != nil {
+						return
+					}
+				}
+			case <-ticker.C:
+				// Reconnecting is then turned away by authRequired, which
+				// EventSource takes as a sign to stop retrying
+				valid, err := s.stillAuthenticated(r.Context())
+				if err != nil {
+					s.logger.Error().Err(err).Int64("userID", userID).Msg("Couldn't recheck message events authentication")
+				} else if !valid {
+					return
+				}
+
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
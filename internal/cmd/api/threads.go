@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func (s *Server) listThread() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_list_thread_duration_seconds",
+		Help: "Histogram for listThread endpoint latency",
+	})
+
+	// listThreadResponse is the first message of a thread along with a page of
+	// its replies
+	type listThreadResponse struct {
+		Root messageResponse `json:"root"`
+		messagePage
+	}
+
+	const (
+		// Asking for the thread of a reply gives the whole thread that it's in
+		selectRootQueryString = "SELECT coalesce(root_id, id) FROM message WHERE id = $1"
+
+		listThreadFilter = "root_id = $4"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		page, err := parseMessagePageRequest(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		var rootID int64
+		err = s.db.QueryRow(r.Context(), selectRootQueryString, messageIDFromContext(r.Context())).Scan(&rootID)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+		roots, err := s.queryMessages(r.Context(), s.db, messageByIDQueryString, rootID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if len(roots) == 0 {
+			s.writeError(w, r, errNotFound("Message not found"))
+			return
+		}
+		if err := s.loadReactions(r.Context(), userID, roots); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if err := s.loadReadBy(r.Context(), roots); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		replies, err := s.pageMessages(r.Context(), userID, listThreadFilter, []interface{}{rootID}, page)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, listThreadResponse{Root: roots[0], messagePage: replies})
+	}
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tokenBytes is how much randomness goes into each bearer token
+	tokenBytes = 32
+
+	// defaultAccessTokenLifetime is how long an access token is valid for
+	// when the server isn't configured with a lifetime
+	defaultAccessTokenLifetime = 15 * time.Minute
+
+	// defaultRefreshTokenLifetime is how long a refresh token is valid for
+	// when the server isn't configured with a lifetime
+	defaultRefreshTokenLifetime = 30 * 24 * time.Hour
+
+	// lastSeenResolution is how stale a token's last_seen_at can get before
+	// it's updated. It keeps authenticating from writing on every request.
+	lastSeenResolution = time.Minute
+
+	// maxUserAgentLength is the most of a client's User-Agent that's kept
+	maxUserAgentLength = 512
+)
+
+// tokenClient describes the client that a token was issued to
+type tokenClient struct {
+	IP        string
+	UserAgent string
+}
+
+// clientFromRequest describes the client that sent r
+func clientFromRequest(r *http.Request) tokenClient {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return tokenClient{IP: ip, UserAgent: strings.ToValidUTF8(userAgent, "")}
+}
+
+// execer is satisfied by both PGDB and pgx.Tx so that tokens can be revoked
+// inside or outside of a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// newOpaqueToken generates a random token for a client along with the hash
+// that's stored in place of it
+func newOpaqueToken() (string, []byte, error) {
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+// hashToken is what tokens are stored and looked up by. The tokens are long
+// and random, so a fast unsalted hash is enough to make a leaked table
+// useless.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func (s *Server) accessTokenLifetime() time.Duration {
+	if s.config.AccessTokenLifetime > 0 {
+		return s.config.AccessTokenLifetime
+	}
+	return defaultAccessTokenLifetime
+}
+
+func (s *Server) refreshTokenLifetime() time.Duration {
+	if s.config.RefreshTokenLifetime > 0 {
+		return s.config.RefreshTokenLifetime
+	}
+	return defaultRefreshTokenLifetime
+}
+
+// tokenResponse is what clients get back whenever a session issues new tokens
+type tokenResponse struct {
+	ID               int64  `json:"id"`
+	Token            string `json:"token"`
+	ExpiresAt        string `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt string `json:"refresh_expires_at"`
+}
+
+// issueTokens generates a new access token and refresh token pair for
+// userID's session. The session's access token is replaced and it's kept alive
+// for as long as the new refresh token.
+func (s *Server) issueTokens(ctx context.Context, tx pgx.Tx, userID int64, sessionID int64) (tokenResponse, error) {
+	const (
+		updateSessionQueryString = `
+UPDATE auth_token
+	SET token_hash = $2,
+		access_expires_at = $3,
+		expires_at = $4
+	WHERE id = $1
+`
+
+		insertRefreshTokenQueryString = `
+INSERT INTO refresh_token (session_id, token_hash, expires_at)
+	VALUES ($1, $2, $3)
+`
+	)
+
+	accessToken, accessTokenHash, err := newOpaqueToken()
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refreshToken, refreshTokenHash, err := newOpaqueToken()
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	now := time.Now()
+	accessExpiresAt := now.Add(s.accessTokenLifetime())
+	refreshExpiresAt := now.Add(s.refreshTokenLifetime())
+
+	if _, err := tx.Exec(ctx, updateSessionQueryString, sessionID, accessTokenHash, accessExpiresAt, refreshExpiresAt); err != nil {
+		return tokenResponse{}, err
+	}
+	if _, err := tx.Exec(ctx, insertRefreshTokenQueryString, sessionID, refreshTokenHash, refreshExpiresAt); err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		ID:               userID,
+		Token:            accessToken,
+		ExpiresAt:        accessExpiresAt.Format(time.RFC3339),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// createSession starts a new login session for userID and issues its first
+// pair of tokens
+func (s *Server) createSession(ctx context.Context, userID int64, client tokenClient) (tokenResponse, error) {
+	const insertSessionQueryString = `
+INSERT INTO auth_token (user_id, token_hash, access_expires_at, expires_at, ip, user_agent)
+	VALUES ($1, $2, now(), now(), $3, $4)
+	RETURNING id
+`
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The placeholder hash is replaced by issueTokens before anyone can see it
+	_, placeholderHash, err := newOpaqueToken()
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	var sessionID int64
+	err = tx.QueryRow(ctx, insertSessionQueryString, userID, placeholderHash, client.IP, client.UserAgent).Scan(&sessionID)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	tokens, err := s.issueTokens(ctx, tx, userID, sessionID)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return tokens, tx.Commit(ctx)
+}
+
+// authenticateToken returns the ID of the access token's session and the ID
+// of the user that it was issued to. Both are 0 when the token is unknown,
+// expired or revoked.
+func (s *Server) authenticateToken(ctx context.Context, token string) (int64, int64, error) {
+	const selectTokenUserQueryString = `
+WITH token AS (
+	SELECT id, user_id, last_seen_at
+		FROM auth_token
+		WHERE token_hash = $1
+			AND access_expires_at > now()
+			AND revoked_at IS NULL
+), seen AS (
+	UPDATE auth_token
+		SET last_seen_at = now()
+		FROM token
+		WHERE auth_token.id = token.id
+			AND token.last_seen_at < now() - $2::interval
+)
+SELECT id, user_id FROM token
+`
+
+	var sessionID, userID int64
+	err := s.db.QueryRow(ctx, selectTokenUserQueryString, hashToken(token), lastSeenResolution).Scan(&sessionID, &userID)
+	if err == pgx.ErrNoRows {
+		return 0, 0, nil
+	}
+	return sessionID, userID, err
+}
+
+// revokeOtherSessions revokes every one of userID's tokens except for the
+// session keepSessionID. Passing 0 revokes all of them.
+func revokeOtherSessions(ctx context.Context, db execer, userID int64, keepSessionID int64) error {
+	const revokeOtherSessionsQueryString = `
+UPDATE auth_token
+	SET revoked_at = now()
+	WHERE user_id = $1
+		AND id <> $2
+		AND revoked_at IS NULL
+		AND expires_at > now()
+`
+
+	_, err := db.Exec(ctx, revokeOtherSessionsQueryString, userID, keepSessionID)
+	return err
+}
+
+func (s *Server) refreshToken() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_refresh_token_duration_seconds",
+		Help: "Histogram for refreshToken endpoint latency",
+	})
+
+	type refreshTokenRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	const (
+		// Locking the refresh token makes concurrent refreshes with the same
+		// token take turns, so only the first one can succeed
+		selectRefreshTokenQueryString = `
+SELECT refresh_token.id, refresh_token.used_at IS NOT NULL, auth_token.id, auth_token.user_id, chat_user.disabled_at IS NOT NULL
+	FROM refresh_token
+		join auth_token ON refresh_token.session_id = auth_token.id
+		join chat_user ON auth_token.user_id = chat_user.id
+	WHERE refresh_token.token_hash = $1
+		AND refresh_token.expires_at > now()
+		AND auth_token.revoked_at IS NULL
+	FOR UPDATE OF refresh_token
+`
+
+		useRefreshTokenQueryString = "UPDATE refresh_token SET used_at = now() WHERE id = $1"
+
+		revokeFamilyQueryString = "UPDATE auth_token SET revoked_at = now() WHERE id = $1"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct refreshTokenRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := validate(field("refresh_token", requestStruct.RefreshToken, required)); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var refreshTokenID, sessionID, userID int64
+		var used, disabled bool
+		err = tx.QueryRow(r.Context(), selectRefreshTokenQueryString, hashToken(requestStruct.RefreshToken)).
+			Scan(&refreshTokenID, &used, &sessionID, &userID, &disabled)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errUnauthorized("Refresh token is invalid, expired or revoked"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if used {
+			// Someone is replaying an old refresh token. We can't tell whether
+			// it's the legitimate client or a thief, so the whole family goes.
+			if _, err := tx.Exec(r.Context(), revokeFamilyQueryString, sessionID); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			if err := tx.Commit(r.Context()); err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			s.logger.Warn().Int64("session", sessionID).Int64("user", userID).Msg("Refresh token was reused, revoked its session")
+			s.writeError(w, r, errUnauthorized("Refresh token is invalid, expired or revoked"))
+			return
+		}
+
+		// The refresh token stays usable in case the user is enabled again
+		if disabled {
+			s.writeError(w, r, errForbidden("Account is disabled"))
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), useRefreshTokenQueryString, refreshTokenID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		tokens, err := s.issueTokens(r.Context(), tx, userID, sessionID)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, tokens)
+	}
+}
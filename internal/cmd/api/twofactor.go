@@ -0,0 +1,534 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abatilo/chat/internal/totp"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// totpIssuer is the name that authenticator apps show for the account
+	totpIssuer = "chat"
+
+	// totpSkew is how many time steps of clock drift are tolerated in either
+	// direction
+	totpSkew = 1
+
+	// recoveryCodeCount is how many recovery codes are handed out when two
+	// factor authentication is turned on
+	recoveryCodeCount = 10
+
+	// recoveryCodeLength is how many base32 characters each recovery code
+	// has, for 50 bits of randomness
+	recoveryCodeLength = 10
+
+	// twoFactorChallengeLifetime is how long a user has to enter their code
+	// after their password was accepted
+	twoFactorChallengeLifetime = 5 * time.Minute
+
+	// maxTwoFactorAttempts is how many wrong codes a user can send, across
+	// every challenge, before they're made to wait
+	maxTwoFactorAttempts = 5
+
+	// sessionPendingUserIDKey is the session key for the user whose password
+	// was accepted but who still owes a two factor code
+	sessionPendingUserIDKey = "pendingTwoFactorUserID"
+
+	// sessionPendingExpiresAtKey is the session key for the Unix time that
+	// the pending two factor challenge expires at
+	sessionPendingExpiresAtKey = "pendingTwoFactorExpiresAt"
+)
+
+// twoFactorChallengeResponse is what login responds with instead of tokens
+// when the user has two factor authentication turned on
+type twoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ExpiresAt         string `json:"expires_at"`
+}
+
+// generateRecoveryCodes creates recoveryCodeCount codes formatted like
+// ABCDE-FGHIJ
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	raw := make([]byte, 7)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := base32.StdEncoding.EncodeToString(raw)[:recoveryCodeLength]
+		codes = append(codes, encoded[:recoveryCodeLength/2]+"-"+encoded[recoveryCodeLength/2:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode ignores the formatting and case that users tend to get
+// wrong when they copy a code by hand
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(normalized)
+}
+
+// startTwoFactorChallenge remembers in the caller's scs session that userID
+// got their password right and now owes a two factor code
+func (s *Server) startTwoFactorChallenge(w http.ResponseWriter, r *http.Request, userID int64) {
+	// Renew the session token on privilege change to prevent session fixation
+	if err := s.sessionManager.RenewToken(r.Context()); err != nil {
+		s.writeError(w, r, errInternal(err))
+		return
+	}
+
+	expiresAt := time.Now().Add(twoFactorChallengeLifetime)
+	s.sessionManager.Put(r.Context(), sessionPendingUserIDKey, userID)
+	s.sessionManager.Put(r.Context(), sessionPendingExpiresAtKey, expiresAt.Unix())
+
+	s.writeJSON(w, http.StatusAccepted, twoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		ExpiresAt:         expiresAt.Format(time.RFC3339),
+	})
+}
+
+// clearTwoFactorChallenge forgets any pending two factor challenge
+func (s *Server) clearTwoFactorChallenge(r *http.Request) {
+	s.sessionManager.Remove(r.Context(), sessionPendingUserIDKey)
+	s.sessionManager.Remove(r.Context(), sessionPendingExpiresAtKey)
+}
+
+func (s *Server) completeTwoFactorLogin() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_complete_two_factor_login_duration_seconds",
+		Help: "Histogram for completeTwoFactorLogin endpoint latency",
+	})
+
+	type completeTwoFactorLoginRequest struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	const (
+		// Locking the user makes concurrent guesses take turns, so each one
+		// sees the failures of the ones before it
+		selectSecretQueryString = "SELECT username, totp_secret, disabled_at IS NOT NULL FROM chat_user WHERE id = $1 AND totp_enabled_at IS NOT NULL FOR UPDATE"
+
+		// A code is only accepted once, even though it's valid for a while
+		useStepQueryString = `
+UPDATE chat_user
+	SET totp_last_step = $2
+	WHERE id = $1
+		AND (totp_last_step IS NULL OR totp_last_step < $2)
+`
+
+		useRecoveryCodeQueryString = `
+UPDATE recovery_code
+	SET used_at = now()
+	WHERE id = (
+		SELECT id
+			FROM recovery_code
+			WHERE user_id = $1
+				AND code_hash = $2
+				AND used_at IS NULL
+			LIMIT 1
+	)
+`
+	)
+
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_two_factor_lockouts_total",
+		Help: "Counter for two factor logins that were locked out after too many wrong codes",
+	}, []string{"scope"})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct completeTwoFactorLoginRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID, _ := s.sessionManager.Get(r.Context(), sessionPendingUserIDKey).(int64)
+		expiresAt, _ := s.sessionManager.Get(r.Context(), sessionPendingExpiresAtKey).(int64)
+		if userID == 0 || time.Now().Unix() > expiresAt {
+			s.clearTwoFactorChallenge(r)
+			s.writeError(w, r, errUnauthorized("No login is waiting for a two factor code"))
+			return
+		}
+
+		err := validate(
+			field("code", requestStruct.Code, ensure(requestStruct.Code != "" || requestStruct.RecoveryCode != "", "either code or recovery_code is required")),
+		)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var username, secret string
+		var disabled bool
+		err = tx.QueryRow(r.Context(), selectSecretQueryString, userID).Scan(&username, &secret, &disabled)
+		if err == pgx.ErrNoRows {
+			// Two factor authentication was turned off in the meantime
+			s.clearTwoFactorChallenge(r)
+			s.writeError(w, r, errUnauthorized("No login is waiting for a two factor code"))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if disabled {
+			s.clearTwoFactorChallenge(r)
+			s.writeError(w, r, errForbidden("Account is disabled"))
+			return
+		}
+
+		// Wrong codes are counted in postgres rather than the session, which
+		// a client could just throw away
+		attemptKeys := twoFactorAttemptKeys(userID, clientFromRequest(r).IP)
+		retryAfter, err := s.loginRetryAfter(r.Context(), attemptKeys)
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			s.writeError(w, r, errTooManyRequests("Too many wrong two factor codes, try again later"))
+			return
+		}
+
+		accepted := false
+		if requestStruct.Code != "" {
+			if step, ok := totp.Validate(secret, requestStruct.Code, time.Now(), totpSkew); ok {
+				tag, err := tx.Exec(r.Context(), useStepQueryString, userID, step)
+				if err != nil {
+					s.writeError(w, r, errInternal(err))
+					return
+				}
+				accepted = tag.RowsAffected() == 1
+			}
+		} else {
+			tag, err := tx.Exec(r.Context(), useRecoveryCodeQueryString, userID, hashRecoveryCode(requestStruct.RecoveryCode))
+			if err != nil {
+				s.writeError(w, r, errInternal(err))
+				return
+			}
+			accepted = tag.RowsAffected() == 1
+		}
+
+		if !accepted {
+			// Recorded before the user row is unlocked so the next guess sees it
+			retryAfter, err := s.recordLoginFailure(r.Context(), attemptKeys, lockouts)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Couldn't record failed two factor code")
+			}
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			}
+			s.writeError(w, r, errUnauthorized("Two factor code is incorrect"))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := s.clearLoginFailures(r.Context(), userID, username); err != nil {
+			s.logger.Error().Err(err).Msg("Couldn't clear failed logins")
+		}
+
+		s.clearTwoFactorChallenge(r)
+		if err := s.sessionManager.RenewToken(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		tokens, err := s.createSession(r.Context(), userID, clientFromRequest(r))
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+func (s *Server) enrollTwoFactor() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_enroll_two_factor_duration_seconds",
+		Help: "Histogram for enrollTwoFactor endpoint latency",
+	})
+
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_enroll_two_factor_lockouts_total",
+		Help: "Counter for attempts to turn on two factor authentication that were locked out after too many wrong passwords",
+	}, []string{"scope"})
+
+	type enrollTwoFactorRequest struct {
+		Password string `json:"password"`
+	}
+
+	type enrollTwoFactorResponse struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+
+	const (
+		selectPasswordQueryString = "SELECT username, password FROM chat_user WHERE id = $1"
+
+		// Enrolling again before verifying replaces the pending secret
+		enrollQueryString = `
+UPDATE chat_user
+	SET totp_secret = $2,
+		totp_last_step = NULL
+	WHERE id = $1
+		AND totp_enabled_at IS NULL
+	RETURNING username
+`
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct enrollTwoFactorRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := validate(field("password", requestStruct.Password, required, maxBytes(maxPasswordBytes))); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		// A stolen access token alone isn't enough to turn it on and lock the
+		// owner out
+		userID := userIDFromContext(r.Context())
+		var username, hashedPassword string
+		if err := s.db.QueryRow(r.Context(), selectPasswordQueryString, userID).Scan(&username, &hashedPassword); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if !s.verifyCurrentPassword(w, r, username, hashedPassword, requestStruct.Password, lockouts) {
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		err = s.db.QueryRow(r.Context(), enrollQueryString, userID, secret).Scan(&username)
+		if err == pgx.ErrNoRows {
+			s.writeError(w, r, errConflict("Two factor authentication is already on", nil))
+			return
+		} else if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusCreated, enrollTwoFactorResponse{
+			Secret:     secret,
+			OTPAuthURI: totp.URI(totpIssuer, username, secret),
+		})
+	}
+}
+
+func (s *Server) verifyTwoFactor() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_verify_two_factor_duration_seconds",
+		Help: "Histogram for verifyTwoFactor endpoint latency",
+	})
+
+	type verifyTwoFactorRequest struct {
+		Code string `json:"code"`
+	}
+
+	type verifyTwoFactorResponse struct {
+		// RecoveryCodes are only ever shown this once
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	const (
+		selectPendingSecretQueryString = "SELECT totp_secret, totp_enabled_at IS NOT NULL FROM chat_user WHERE id = $1 FOR UPDATE"
+
+		enableQueryString = "UPDATE chat_user SET totp_enabled_at = now(), totp_last_step = $2 WHERE id = $1"
+
+		deleteRecoveryCodesQueryString = "DELETE FROM recovery_code WHERE user_id = $1"
+
+		insertRecoveryCodesQueryString = "INSERT INTO recovery_code (user_id, code_hash) SELECT $1, unnest($2::bytea[])"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct verifyTwoFactorRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := validate(field("code", requestStruct.Code, required)); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var secret *string
+		var enabled bool
+		if err := tx.QueryRow(r.Context(), selectPendingSecretQueryString, userID).Scan(&secret, &enabled); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if enabled {
+			s.writeError(w, r, errConflict("Two factor authentication is already on", nil))
+			return
+		}
+		if secret == nil {
+			s.writeError(w, r, errUnprocessable("Two factor authentication hasn't been enrolled", nil))
+			return
+		}
+
+		step, ok := totp.Validate(*secret, requestStruct.Code, time.Now(), totpSkew)
+		if err := validate(field("code", requestStruct.Code, ensure(ok, "is incorrect"))); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		codes, err := generateRecoveryCodes()
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		codeHashes := make([][]byte, 0, len(codes))
+		for _, code := range codes {
+			codeHashes = append(codeHashes, hashRecoveryCode(code))
+		}
+
+		if _, err := tx.Exec(r.Context(), enableQueryString, userID, step); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if _, err := tx.Exec(r.Context(), deleteRecoveryCodesQueryString, userID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if _, err := tx.Exec(r.Context(), insertRecoveryCodesQueryString, userID, codeHashes); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, verifyTwoFactorResponse{RecoveryCodes: codes})
+	}
+}
+
+func (s *Server) disableTwoFactor() http.HandlerFunc {
+	duration := s.metrics.NewHistogram(prometheus.HistogramOpts{
+		Name: "chat_disable_two_factor_duration_seconds",
+		Help: "Histogram for disableTwoFactor endpoint latency",
+	})
+
+	lockouts := s.metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_disable_two_factor_lockouts_total",
+		Help: "Counter for attempts to turn off two factor authentication that were locked out after too many wrong passwords",
+	}, []string{"scope"})
+
+	type disableTwoFactorRequest struct {
+		Password string `json:"password"`
+	}
+
+	const (
+		selectPasswordQueryString = "SELECT username, password FROM chat_user WHERE id = $1 FOR UPDATE"
+
+		disableQueryString = `
+UPDATE chat_user
+	SET totp_secret = NULL,
+		totp_enabled_at = NULL,
+		totp_last_step = NULL
+	WHERE id = $1
+`
+
+		deleteRecoveryCodesQueryString = "DELETE FROM recovery_code WHERE user_id = $1"
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		defer func() { duration.Observe(time.Since(startTime).Seconds()) }()
+
+		// Parse request
+		var requestStruct disableTwoFactorRequest
+		if err := decodeJSON(r, &requestStruct); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		if err := validate(field("password", requestStruct.Password, required, maxBytes(maxPasswordBytes))); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		userID := userIDFromContext(r.Context())
+		tx, err := s.db.Begin(r.Context())
+		if err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		// A stolen access token alone isn't enough to turn it off
+		var username, hashedPassword string
+		if err := tx.QueryRow(r.Context(), selectPasswordQueryString, userID).Scan(&username, &hashedPassword); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if !s.verifyCurrentPassword(w, r, username, hashedPassword, requestStruct.Password, lockouts) {
+			return
+		}
+
+		if _, err := tx.Exec(r.Context(), disableQueryString, userID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+		if _, err := tx.Exec(r.Context(), deleteRecoveryCodesQueryString, userID); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			s.writeError(w, r, errInternal(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxPasswordBytes is the most bytes bcrypt will consider. Anything past
+	// this is silently ignored, so we refuse it instead.
+	maxPasswordBytes = 72
+
+	// minPasswordLength is the fewest characters a password may have
+	minPasswordLength = 8
+
+	// maxTextLength is the most characters a text message may have
+	maxTextLength = 4096
+
+	// maxImageDimension is the largest value the smallint image_message.width
+	// and image_message.height columns can hold
+	maxImageDimension = 32767
+
+	// maxAudioDurationMS is the largest value the integer
+	// audio_message.duration_ms column can hold
+	maxAudioDurationMS = math.MaxInt32
+
+	// maxFilenameLength is the most characters an uploaded file's name may have
+	maxFilenameLength = 255
+
+	// maxEmailLength is the longest email address that can be delivered to
+	maxEmailLength = 254
+
+	// maxEmojiBytes is the longest reaction. It leaves room for sequences of
+	// several emoji joined together, like families and flags.
+	maxEmojiBytes = 64
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// FieldError describes why a single field of a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// rule checks a single value and returns a message describing why the value
+// is invalid, or an empty string if it's valid
+type rule func(value interface{}) string
+
+type fieldRules struct {
+	name  string
+	value interface{}
+	rules []rule
+}
+
+// field declares the rules that a named request field must satisfy
+func field(name string, value interface{}, rules ...rule) fieldRules {
+	return fieldRules{name: name, value: value, rules: rules}
+}
+
+// validate runs every rule for every field and reports all failures at once.
+// Only the first failing rule of each field is reported.
+func validate(fields ...fieldRules) error {
+	var fieldErrors []FieldError
+	for _, f := range fields {
+		for _, check := range f.rules {
+			if message := check(f.value); message != "" {
+				fieldErrors = append(fieldErrors, FieldError{Field: f.name, Message: message})
+				break
+			}
+		}
+	}
+
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+
+	return &Error{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: "Request failed validation",
+		Details: fieldErrors,
+	}
+}
+
+func required(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return "is required"
+		}
+	case int64:
+		if v == 0 {
+			return "is required"
+		}
+	case uint64:
+		if v == 0 {
+			return "is required"
+		}
+	case []int64:
+		if len(v) == 0 {
+			return "is required"
+		}
+	case []string:
+		if len(v) == 0 {
+			return "is required"
+		}
+	}
+	return ""
+}
+
+func maxLength(n int) rule {
+	return func(value interface{}) string {
+		if utf8.RuneCountInString(value.(string)) > n {
+			return fmt.Sprintf("must be at most %d characters", n)
+		}
+		return ""
+	}
+}
+
+func maxItems(n int) rule {
+	return func(value interface{}) string {
+		if len(value.([]int64)) > n {
+			return fmt.Sprintf("must have at most %d items", n)
+		}
+		return ""
+	}
+}
+
+func maxBytes(n int) rule {
+	return func(value interface{}) string {
+		if len(value.(string)) > n {
+			return fmt.Sprintf("must be at most %d bytes", n)
+		}
+		return ""
+	}
+}
+
+func between(min, max uint64) rule {
+	return func(value interface{}) string {
+		if v := value.(uint64); v < min || v > max {
+			return fmt.Sprintf("must be between %d and %d", min, max)
+		}
+		return ""
+	}
+}
+
+func matches(pattern *regexp.Regexp, description string) rule {
+	return func(value interface{}) string {
+		if !pattern.MatchString(value.(string)) {
+			return description
+		}
+		return ""
+	}
+}
+
+func oneOf(options ...string) rule {
+	return func(value interface{}) string {
+		for _, option := range options {
+			if value.(string) == option {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %q", options)
+	}
+}
+
+// eachOneOf is oneOf for every item of a list of strings
+func eachOneOf(options ...string) rule {
+	check := oneOf(options...)
+	return func(value interface{}) string {
+		for _, item := range value.([]string) {
+			if message := check(item); message != "" {
+				return "items " + message
+			}
+		}
+		return ""
+	}
+}
+
+func absoluteURL(value interface{}) string {
+	u, err := url.Parse(value.(string))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "must be an absolute http or https URL"
+	}
+	return ""
+}
+
+// emailAddress requires a bare address like user@example.com, without a
+// display name
+func emailAddress(value interface{}) string {
+	address, err := mail.ParseAddress(value.(string))
+	if err != nil || address.Address != value.(string) {
+		return "must be an email address"
+	}
+	return ""
+}
+
+func uuidString(value interface{}) string {
+	if _, err := uuid.Parse(value.(string)); err != nil {
+		return "must be a UUID"
+	}
+	return ""
+}
+
+// strongPassword requires a minimum length and a mix of at least two kinds of
+// characters out of lowercase, uppercase, digits and symbols
+func strongPassword(value interface{}) string {
+	password := value.(string)
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Sprintf("must be at least %d characters", minPasswordLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return "must mix at least two of lowercase letters, uppercase letters, digits and symbols"
+	}
+	return ""
+}
+
+// emoji requires a single emoji, which can be a sequence of code points such
+// as a flag, a keycap or an emoji with a skin tone
+func emoji(value interface{}) string {
+	var symbol bool
+	for _, c := range value.(string) {
+		switch {
+		case unicode.Is(unicode.So, c):
+			symbol = true
+		case unicode.In(c, unicode.Sk, unicode.Mn, unicode.Me):
+			// Skin tones, variation selectors and the keycap
+		case c == '\u200d' || (c >= '\U000e0020' && c <= '\U000e007f'):
+			// Zero width joiners and the tags of subdivision flags
+		case (c >= '0' && c <= '9') || c == '#' || c == '*':
+			// The base of a keycap
+		default:
+			return "must be an emoji"
+		}
+	}
+	if !symbol && !strings.ContainsRune(value.(string), '\u20e3') {
+		return "must be an emoji"
+	}
+	return ""
+}
+
+// ensure turns a check that was done ahead of time, such as a database lookup,
+// into a rule
+func ensure(ok bool, message string) rule {
+	return func(value interface{}) string {
+		if !ok {
+			return message
+		}
+		return ""
+	}
+}
+
+// userExists reports whether there's a chat_user with the given ID
+func (s *Server) userExists(ctx context.Context, userID int64) (bool, error) {
+	const userExistsQueryString = "SELECT EXISTS (SELECT 1 FROM chat_user WHERE id = $1)"
+
+	var exists bool
+	err := s.db.QueryRow(ctx, userExistsQueryString, userID).Scan(&exists)
+	return exists, err
+}
+
+// usersExist reports whether every ID in userIDs belongs to a chat_user
+func (s *Server) usersExist(ctx context.Context, userIDs []int64) (bool, error) {
+	const usersExistQueryString = "SELECT count(*) = cardinality(array(SELECT DISTINCT unnest($1::bigint[]))) FROM chat_user WHERE id = ANY($1)"
+
+	var exist bool
+	err := s.db.QueryRow(ctx, usersExistQueryString, userIDs).Scan(&exist)
+	return exist, err
+}
@@ -0,0 +1,190 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Message is a single plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// headerSanitizer strips line breaks so that values can't inject headers
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+// sendTimeout bounds how long delivering a single message can take when the
+// caller's context doesn't set a shorter deadline
+const sendTimeout = 30 * time.Second
+
+// SMTPMailer sends email through an SMTP server
+type SMTPMailer struct {
+	host string
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer that sends from the from address through the
+// SMTP server at host and port. It only authenticates when username is set.
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{
+		host: host,
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send delivers msg, giving up when ctx is done or after sendTimeout
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerSanitizer.Replace(m.from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSanitizer.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerSanitizer.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The SMTP client doesn't take a context, so every read and write is
+	// bounded by the deadline and the connection is closed if ctx is cancelled
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := m.send(conn, msg.To, b.String()); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// send runs the SMTP conversation for a single message over conn, the same
+// way that smtp.SendMail does
+func (m *SMTPMailer) send(conn net.Conn, to string, data string) error {
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// LogMailer writes email to a logger instead of sending it, for running
+// locally without an SMTP server. Bodies hold secrets like password reset
+// tokens, so they're left out unless they're asked for.
+type LogMailer struct {
+	logger    zerolog.Logger
+	logBodies bool
+}
+
+// NewLogMailer creates a mailer that writes every message to logger. Bodies
+// are only logged when logBodies is set, which is only safe for development.
+func NewLogMailer(logger zerolog.Logger, logBodies bool) *LogMailer {
+	return &LogMailer{logger: logger, logBodies: logBodies}
+}
+
+// Send logs who msg is for and what it's about, and its body if that was
+// asked for
+func (l *LogMailer) Send(ctx context.Context, msg Message) error {
+	event := l.logger.Info().Str("to", msg.To).Str("subject", msg.Subject)
+	if l.logBodies {
+		event = event.Str("body", msg.Body)
+	} else {
+		event = event.Int("bodyBytes", len(msg.Body))
+	}
+	event.Msg("Sending email")
+	return nil
+}
+
+// MemoryMailer keeps every message that it's asked to send, for tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send records msg
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns every message sent so far, oldest first
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
@@ -0,0 +1,342 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkew is how far apart our clock and the provider's can be
+	clockSkew = time.Minute
+
+	// minKeyRefreshInterval limits how often an unknown key ID makes us fetch
+	// the provider's keys again, so that forged tokens can't hammer it
+	minKeyRefreshInterval = time.Minute
+)
+
+// ErrInvalidIDToken is returned for an ID token that can't be trusted
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// IDToken is what a verified ID token says about the user
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// audience is the aud claim, which can be a single string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidIDToken, fmt.Sprintf(format, args...))
+}
+
+// verify checks the signature and claims of rawIDToken as of now
+func (p *Provider) verify(ctx context.Context, rawIDToken, nonce string, now time.Time) (*IDToken, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed token")
+	}
+
+	var header idTokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalid("malformed header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature: %v", err)
+	}
+
+	key, err := p.keys.get(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	// Nothing in the payload is looked at until it's known to be from the
+	// provider
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed claims: %v", err)
+	}
+
+	switch {
+	case claims.Issuer != p.config.IssuerURL:
+		return nil, invalid("issued by %q", claims.Issuer)
+	case claims.Subject == "":
+		return nil, invalid("missing subject")
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, invalid("not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, invalid("not authorized for this client")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)):
+		return nil, invalid("expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, invalid("issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, invalid("nonce doesn't match")
+	}
+
+	return &IDToken{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// verifySignature checks signature over signed with key. The algorithm has to
+// suit the key so that a token can't pick a weaker check than intended, and
+// "none" is never accepted.
+func verifySignature(algorithm string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return invalid("unsupported algorithm %q", algorithm)
+	}
+
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			return invalid("algorithm %q doesn't match an RSA key", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return invalid("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			return invalid("algorithm %q doesn't match an EC key", algorithm)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid("bad signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalid("bad signature")
+		}
+	default:
+		return invalid("unsupported key type")
+	}
+	return nil
+}
+
+// jsonWebKey is the part of a JWK that we use
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point isn't on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+// keySet caches the provider's signing keys by key ID. They're fetched again
+// when a token names a key that isn't known, which is how providers rotate.
+type keySet struct {
+	uri     string
+	getJSON func(ctx context.Context, target string, v interface{}) error
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	refreshedAt time.Time
+}
+
+func newKeySet(uri string, getJSON func(ctx context.Context, target string, v interface{}) error) *keySet {
+	return &keySet{uri: uri, getJSON: getJSON}
+}
+
+func (ks *keySet) get(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if key, ok := ks.lookup(keyID); ok {
+		return key, nil
+	}
+
+	if time.Since(ks.refreshedAt) < minKeyRefreshInterval {
+		return nil, invalid("unknown key %q", keyID)
+	}
+	if err := ks.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("fetching provider keys: %w", err)
+	}
+
+	if key, ok := ks.lookup(keyID); ok {
+		return key, nil
+	}
+	return nil, invalid("unknown key %q", keyID)
+}
+
+// lookup finds a key by ID. Tokens without a key ID are only accepted when
+// there's no doubt about which key signed them.
+func (ks *keySet) lookup(keyID string) (crypto.PublicKey, bool) {
+	if keyID == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[keyID]
+	return key, ok
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := ks.getJSON(ctx, ks.uri, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// One key we don't understand shouldn't stop the others from
+			// being used
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	ks.keys = keys
+	ks.refreshedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,452 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testClientID = "chat"
+	testNonce    = "n-0S6_WzA2Mj"
+)
+
+// testKeys are signing keys generated for the tests, served by a fake JWKS
+// endpoint that counts how often it's fetched
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ec256 *ecdsa.PrivateKey
+	ec384 *ecdsa.PrivateKey
+
+	// served is the JWKS that the fake endpoint responds with
+	served  []jsonWebKey
+	fetches int
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &testKeys{rsa: rsaKey, ec256: ec256, ec384: ec384}
+	keys.served = []jsonWebKey{
+		rsaJWK("rsa", &rsaKey.PublicKey),
+		ecJWK("ec256", "P-256", &ec256.PublicKey),
+		ecJWK("ec384", "P-384", &ec384.PublicKey),
+	}
+	return keys
+}
+
+func (k *testKeys) getJSON(ctx context.Context, target string, v interface{}) error {
+	k.fetches++
+	raw, err := json.Marshal(map[string]interface{}{"keys": k.served})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (k *testKeys) provider() *Provider {
+	return &Provider{
+		config: Config{IssuerURL: testIssuer, ClientID: testClientID},
+		keys:   newKeySet("https://issuer.example.com/jwks", k.getJSON),
+	}
+}
+
+func rsaJWK(keyID string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		KeyType: "RSA",
+		KeyID:   keyID,
+		Use:     "sig",
+		N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(keyID, curve string, key *ecdsa.PublicKey) jsonWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jsonWebKey{
+		KeyType: "EC",
+		KeyID:   keyID,
+		Use:     "sig",
+		Curve:   curve,
+		X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// signToken builds a token with header and claims, signed with key using
+// hash. A nil key leaves the signature empty.
+func signToken(t *testing.T, header, claims map[string]interface{}, key crypto.Signer, hash crypto.Hash) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := encode(header) + "." + encode(claims)
+	if key == nil {
+		return signed + "."
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                testIssuer,
+		"sub":                "248289761001",
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              testNonce,
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "jane",
+		"name":               "Jane Doe",
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now()
+
+	// with returns the valid claims with changes applied. A nil value removes
+	// the claim.
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := validClaims(now)
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		return claims
+	}
+	header := func(alg, kid string) map[string]interface{} {
+		return map[string]interface{}{"alg": alg, "kid": kid, "typ": "JWT"}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{
+			name:  "RS256",
+			token: signToken(t, header("RS256", "rsa"), validClaims(now), keys.rsa, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "RS512",
+			token: signToken(t, header("RS512", "rsa"), validClaims(now), keys.rsa, crypto.SHA512),
+			valid: true,
+		},
+		{
+			name:  "ES256",
+			token: signToken(t, header("ES256", "ec256"), validClaims(now), keys.ec256, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "ES384",
+			token: signToken(t, header("ES384", "ec384"), validClaims(now), keys.ec384, crypto.SHA384),
+			valid: true,
+		},
+		{
+			name:  "audience list with azp",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": []string{testClientID, "other"}, "azp": testClientID}), keys.rsa, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "audience list of one without azp",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": []string{testClientID}}), keys.rsa, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "expired within the allowed skew",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"exp": now.Add(-clockSkew / 2).Unix()}), keys.rsa, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "issued in the future within the allowed skew",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"iat": now.Add(clockSkew / 2).Unix()}), keys.rsa, crypto.SHA256),
+			valid: true,
+		},
+		{
+			name:  "malformed",
+			token: "not.a-token",
+		},
+		{
+			name:  "alg none",
+			token: signToken(t, header("none", "rsa"), validClaims(now), nil, 0),
+		},
+		{
+			name:  "alg none without a key ID",
+			token: signToken(t, map[string]interface{}{"alg": "none"}, validClaims(now), nil, 0),
+		},
+		{
+			name:  "HMAC",
+			token: signToken(t, header("HS256", "rsa"), validClaims(now), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "EC algorithm with an RSA key",
+			token: signToken(t, header("ES256", "rsa"), validClaims(now), keys.ec256, crypto.SHA256),
+		},
+		{
+			name:  "RSA algorithm with an EC key",
+			token: signToken(t, header("RS256", "ec256"), validClaims(now), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "signed by a different key",
+			token: signToken(t, header("ES256", "ec256"), validClaims(now), keys.ec384, crypto.SHA256),
+		},
+		{
+			name:  "hash doesn't match alg",
+			token: signToken(t, header("RS256", "rsa"), validClaims(now), keys.rsa, crypto.SHA512),
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				parts := strings.Split(signToken(t, header("RS256", "rsa"), validClaims(now), keys.rsa, crypto.SHA256), ".")
+				tampered := strings.Split(signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"sub": "admin"}), keys.rsa, crypto.SHA256), ".")
+				return parts[0] + "." + tampered[1] + "." + parts[2]
+			}(),
+		},
+		{
+			name:  "wrong issuer",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"iss": "https://evil.example.com"}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "issuer with a trailing slash",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"iss": testIssuer + "/"}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "missing subject",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"sub": nil}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "wrong audience",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": "someone-else"}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "missing audience",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": nil}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "audience list without azp",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": []string{testClientID, "other"}}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "audience list with someone else's azp",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"aud": []string{testClientID, "other"}, "azp": "other"}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "expired",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"exp": now.Add(-2 * clockSkew).Unix()}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "missing expiry",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"exp": nil}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "issued in the future",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"iat": now.Add(2 * clockSkew).Unix()}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "wrong nonce",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"nonce": "replayed"}), keys.rsa, crypto.SHA256),
+		},
+		{
+			name:  "missing nonce",
+			token: signToken(t, header("RS256", "rsa"), with(map[string]interface{}{"nonce": nil}), keys.rsa, crypto.SHA256),
+		},
+	}
+
+	p := keys.provider()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idToken, err := p.verify(context.Background(), test.token, testNonce, now)
+			if !test.valid {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("verify = %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("verify = %v", err)
+			}
+			want := IDToken{
+				Issuer:            testIssuer,
+				Subject:           "248289761001",
+				Email:             "jane@example.com",
+				EmailVerified:     true,
+				PreferredUsername: "jane",
+				Name:              "Jane Doe",
+			}
+			if *idToken != want {
+				t.Errorf("verify = %+v, want %+v", *idToken, want)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutKeyID(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now()
+	token := signToken(t, map[string]interface{}{"alg": "RS256"}, validClaims(now), keys.rsa, crypto.SHA256)
+
+	// With several keys to choose from, none of them is assumed
+	if _, err := keys.provider().verify(context.Background(), token, testNonce, now); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("verify with several keys = %v, want ErrInvalidIDToken", err)
+	}
+
+	keys.served = keys.served[:1]
+	if _, err := keys.provider().verify(context.Background(), token, testNonce, now); err != nil {
+		t.Errorf("verify with a single key = %v", err)
+	}
+}
+
+func TestUnknownKeyRefresh(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now()
+	p := keys.provider()
+	ctx := context.Background()
+
+	known := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims(now), keys.rsa, crypto.SHA256)
+	if _, err := p.verify(ctx, known, testNonce, now); err != nil {
+		t.Fatalf("verify = %v", err)
+	}
+	if keys.fetches != 1 {
+		t.Fatalf("fetched keys %d times for the first token, want 1", keys.fetches)
+	}
+
+	// Known keys are served from the cache
+	if _, err := p.verify(ctx, known, testNonce, now); err != nil {
+		t.Fatalf("verify = %v", err)
+	}
+	if keys.fetches != 1 {
+		t.Errorf("fetched keys %d times for a known key, want 1", keys.fetches)
+	}
+
+	// A flood of tokens naming unknown keys doesn't reach the provider until
+	// the interval is up
+	for i := 0; i < 10; i++ {
+		forged := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "forged"}, validClaims(now), keys.rsa, crypto.SHA256)
+		if _, err := p.verify(ctx, forged, testNonce, now); !errors.Is(err, ErrInvalidIDToken) {
+			t.Fatalf("verify with an unknown key = %v, want ErrInvalidIDToken", err)
+		}
+	}
+	if keys.fetches != 1 {
+		t.Errorf("fetched keys %d times for unknown keys within the interval, want 1", keys.fetches)
+	}
+
+	// The provider rotates in a new key, which is picked up once the
+	// interval is up, and only with a single fetch
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.served = append(keys.served, ecJWK("rotated", "P-256", &rotated.PublicKey))
+	token := signToken(t, map[string]interface{}{"alg": "ES256", "kid": "rotated"}, validClaims(now), rotated, crypto.SHA256)
+
+	if _, err := p.verify(ctx, token, testNonce, now); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("verify with a rotated key within the interval = %v, want ErrInvalidIDToken", err)
+	}
+	if keys.fetches != 1 {
+		t.Errorf("fetched keys %d times within the interval, want 1", keys.fetches)
+	}
+
+	p.keys.refreshedAt = time.Now().Add(-minKeyRefreshInterval)
+	if _, err := p.verify(ctx, token, testNonce, now); err != nil {
+		t.Fatalf("verify with a rotated key after the interval = %v", err)
+	}
+	if _, err := p.verify(ctx, token, testNonce, now); err != nil {
+		t.Fatalf("verify with a rotated key after the interval = %v", err)
+	}
+	if keys.fetches != 2 {
+		t.Errorf("fetched keys %d times after the interval, want 2", keys.fetches)
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	keys := newTestKeys(t)
+
+	offCurve := ecJWK("off", "P-256", &keys.ec256.PublicKey)
+	offCurve.Y = base64.RawURLEncoding.EncodeToString(big.NewInt(1).Bytes())
+
+	wrongCurve := ecJWK("wrong", "P-384", &keys.ec256.PublicKey)
+
+	hugeExponent := rsaJWK("huge", &keys.rsa.PublicKey)
+	hugeExponent.E = base64.RawURLEncoding.EncodeToString(new(big.Int).Lsh(big.NewInt(1), 64).Bytes())
+
+	tests := []struct {
+		name string
+		jwk  jsonWebKey
+		ok   bool
+	}{
+		{"RSA", keys.served[0], true},
+		{"P-256", keys.served[1], true},
+		{"P-384", keys.served[2], true},
+		{"point off the curve", offCurve, false},
+		{"point on a different curve", wrongCurve, false},
+		{"unsupported curve", jsonWebKey{KeyType: "EC", Curve: "secp256k1"}, false},
+		{"RSA exponent too large", hugeExponent, false},
+		{"symmetric key", jsonWebKey{KeyType: "oct"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.jwk.publicKey()
+			if (err == nil) != test.ok {
+				t.Errorf("publicKey = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
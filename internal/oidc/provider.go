@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseBytes is the most that's read from any response of the provider
+const maxResponseBytes = 1 << 20
+
+// Config describes how to reach an OpenID Connect provider and who we are to
+// it
+type Config struct {
+	// IssuerURL is where the provider's discovery document lives, under
+	// /.well-known/openid-configuration. It must match the iss claim of its
+	// ID tokens exactly.
+	IssuerURL string
+
+	// ClientID and ClientSecret identify us to the provider. Public clients
+	// leave ClientSecret empty and rely on PKCE alone.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is where the provider sends the user back to, which is our
+	// callback endpoint
+	RedirectURL string
+
+	// Scopes are requested along with openid
+	Scopes []string
+}
+
+// discoveryDocument is the part of the provider metadata that we use
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow against a single OpenID Connect
+// provider. Its metadata is discovered the first time it's needed, so the
+// provider doesn't have to be up when we start.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      *keySet
+}
+
+// NewProvider creates a provider from config. client is used for every
+// request to the provider.
+func NewProvider(config Config, client *http.Client) *Provider {
+	return &Provider{config: config, client: client}
+}
+
+// metadata returns the provider's discovery document, fetching it if it hasn't
+// been yet
+func (p *Provider) metadata(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var doc discoveryDocument
+	if err := p.getJSON(ctx, discoveryURL, &doc); err != nil {
+		return nil, fmt.Errorf("discovering provider: %w", err)
+	}
+
+	// Spec requires an exact match so that one provider can't vouch for
+	// another
+	if doc.Issuer != p.config.IssuerURL {
+		return nil, fmt.Errorf("provider says its issuer is %q, expected %q", doc.Issuer, p.config.IssuerURL)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+
+	p.discovery = &doc
+	p.keys = newKeySet(doc.JWKSURI, p.getJSON)
+	return p.discovery, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// AuthCodeURL is where to send the user to sign in. state and nonce tie the
+// callback and ID token back to this attempt, and codeChallenge is the PKCE
+// S256 challenge of the verifier that Exchange gets.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(doc.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return authURL.String(), nil
+}
+
+// tokenResponse is the part of the token endpoint's response that we use
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades an authorization code for the user's verified ID token
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDToken, error) {
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("token endpoint responded with %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("token endpoint responded with %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token endpoint didn't return an ID token")
+	}
+
+	return p.verify(ctx, token.IDToken, nonce, time.Now())
+}
+
+// RandomString returns a URL safe random string, for state, nonce and PKCE
+// verifiers
+func RandomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// CodeChallenge is the PKCE S256 challenge for verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
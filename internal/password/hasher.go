@@ -0,0 +1,188 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrMismatch is returned when a password doesn't match its hash
+	ErrMismatch = errors.New("password doesn't match hash")
+
+	// ErrUnknownAlgorithm is returned for a hash that no Hasher understands
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+)
+
+// Hasher hashes passwords under a single policy. Hashes are self describing,
+// so they carry their algorithm and parameters with them.
+type Hasher interface {
+	// Hash hashes password under this policy
+	Hash(password string) (string, error)
+
+	// NeedsRehash reports whether hash was made under a different policy and
+	// should be replaced the next time the password is known
+	NeedsRehash(hash string) bool
+}
+
+// Verify checks password against hash, whichever algorithm made it
+func Verify(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	case strings.HasPrefix(hash, argon2idPrefix):
+		return verifyArgon2id(hash, password)
+	default:
+		return ErrUnknownAlgorithm
+	}
+}
+
+// Bcrypt hashes with bcrypt at a fixed cost
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash hashes password with bcrypt
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+// NeedsRehash reports whether hash isn't bcrypt at this cost
+func (b Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+// argon2idPrefix starts every argon2id hash in the PHC string format
+const argon2idPrefix = "$argon2id$"
+
+const (
+	// minArgon2idSaltLength is the shortest salt that the argon2 spec allows
+	minArgon2idSaltLength = 8
+
+	// minArgon2idKeyLength is the shortest key that the argon2 spec allows.
+	// Without a minimum, a hash with an empty key would match any password.
+	minArgon2idKeyLength = 4
+)
+
+// Argon2id hashes with argon2id. Hashes use the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2id struct {
+	// Time is the number of passes over the memory
+	Time uint32
+
+	// Memory is how much memory is used, in KiB
+	Memory uint32
+
+	// Threads is the degree of parallelism
+	Threads uint8
+
+	// SaltLength is how many random bytes of salt each hash gets
+	SaltLength int
+
+	// KeyLength is how many bytes the derived key is
+	KeyLength uint32
+}
+
+// DefaultArgon2id follows the second recommended option from RFC 9106 for
+// when memory is constrained, with 64 MiB of memory
+func DefaultArgon2id() Argon2id {
+	return Argon2id{Time: 3, Memory: 64 * 1024, Threads: 4, SaltLength: 16, KeyLength: 32}
+}
+
+// Hash hashes password with argon2id
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLength)
+	return a.encode(salt, key), nil
+}
+
+func (a Argon2id) encode(salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+// NeedsRehash reports whether hash isn't argon2id with these parameters
+func (a Argon2id) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time != a.Time ||
+		params.Memory != a.Memory ||
+		params.Threads != a.Threads ||
+		len(salt) != a.SaltLength ||
+		uint32(len(key)) != a.KeyLength
+}
+
+func decodeArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2id{}, nil, nil, ErrUnknownAlgorithm
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2id{}, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var params Argon2id
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return Argon2id{}, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	// argon2 panics instead of returning an error for these
+	if params.Time < 1 || params.Threads < 1 {
+		return Argon2id{}, nil, nil, fmt.Errorf("argon2id parameters out of range %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2id{}, nil, nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2id{}, nil, nil, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+
+	if len(salt) < minArgon2idSaltLength || len(key) < minArgon2idKeyLength {
+		return Argon2id{}, nil, nil, fmt.Errorf("argon2id salt or key is too short")
+	}
+
+	params.SaltLength = len(salt)
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func verifyArgon2id(hash, password string) error {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
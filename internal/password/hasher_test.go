@@ -0,0 +1,166 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2id keeps the tests fast. The parameters don't change anything
+// about how hashes are encoded or checked.
+func cheapArgon2id() Argon2id {
+	return Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestRoundTrip(t *testing.T) {
+	hashers := []struct {
+		name   string
+		hasher Hasher
+	}{
+		{"bcrypt", Bcrypt{Cost: bcrypt.MinCost}},
+		{"argon2id", cheapArgon2id()},
+	}
+
+	for _, test := range hashers {
+		t.Run(test.name, func(t *testing.T) {
+			hash, err := test.hasher.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Verify(hash, "correct horse battery staple"); err != nil {
+				t.Errorf("Verify with the right password = %v", err)
+			}
+			if err := Verify(hash, "correct horse battery stapler"); !errors.Is(err, ErrMismatch) {
+				t.Errorf("Verify with the wrong password = %v, want ErrMismatch", err)
+			}
+			if err := Verify(hash, ""); !errors.Is(err, ErrMismatch) {
+				t.Errorf("Verify with an empty password = %v, want ErrMismatch", err)
+			}
+			if test.hasher.NeedsRehash(hash) {
+				t.Error("NeedsRehash is true for a hash that it just made")
+			}
+
+			// Every hash is salted
+			again, err := test.hasher.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again == hash {
+				t.Error("hashing the same password twice gave the same hash")
+			}
+		})
+	}
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	hash, err := cheapArgon2id().Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q isn't in the PHC string format", hash)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon2idHash, err := cheapArgon2id().Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := Bcrypt{Cost: bcrypt.MinCost}.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moreTime := cheapArgon2id()
+	moreTime.Time++
+	moreMemory := cheapArgon2id()
+	moreMemory.Memory *= 2
+	moreThreads := cheapArgon2id()
+	moreThreads.Threads++
+	longerSalt := cheapArgon2id()
+	longerSalt.SaltLength *= 2
+	longerKey := cheapArgon2id()
+	longerKey.KeyLength *= 2
+
+	tests := []struct {
+		name   string
+		hasher Hasher
+		hash   string
+		want   bool
+	}{
+		{"same argon2id parameters", cheapArgon2id(), argon2idHash, false},
+		{"argon2id time changed", moreTime, argon2idHash, true},
+		{"argon2id memory changed", moreMemory, argon2idHash, true},
+		{"argon2id threads changed", moreThreads, argon2idHash, true},
+		{"argon2id salt length changed", longerSalt, argon2idHash, true},
+		{"argon2id key length changed", longerKey, argon2idHash, true},
+		{"same bcrypt cost", Bcrypt{Cost: bcrypt.MinCost}, bcryptHash, false},
+		{"bcrypt cost changed", Bcrypt{Cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"argon2id policy with a bcrypt hash", cheapArgon2id(), bcryptHash, true},
+		{"bcrypt policy with an argon2id hash", Bcrypt{Cost: bcrypt.MinCost}, argon2idHash, true},
+		{"argon2id policy with garbage", cheapArgon2id(), "garbage", true},
+		{"bcrypt policy with garbage", Bcrypt{Cost: bcrypt.MinCost}, "garbage", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.hasher.NeedsRehash(test.hash); got != test.want {
+				t.Errorf("NeedsRehash = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	// salt and key are valid base64 of 16 and 32 bytes, so that each case
+	// below only breaks one thing
+	const (
+		salt = "c29tZXNhbHRzb21lc2FsdA"
+		key  = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	)
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"unknown algorithm", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"plaintext", "password"},
+		{"prefix only", "$argon2id$"},
+		{"missing key", "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"extra field", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$"},
+		{"wrong version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing version", "$argon2id$$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing parameters", "$argon2id$v=19$$" + salt + "$" + key},
+		{"parameters out of order", "$argon2id$v=19$t=1,m=64,p=1$" + salt + "$" + key},
+		{"no passes", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"no threads", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"too many threads", "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key},
+		{"negative memory", "$argon2id$v=19$m=-64,t=1,p=1$" + salt + "$" + key},
+		{"salt isn't base64", "$argon2id$v=19$m=64,t=1,p=1$!!!!$" + key},
+		{"key isn't base64", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!!"},
+		{"empty salt", "$argon2id$v=19$m=64,t=1,p=1$$" + key},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{"truncated bcrypt", "$2a$04$"},
+		{"bcrypt with a bad cost", "$2a$99$" + strings.Repeat("a", 53)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify(test.hash, "password")
+			if err == nil {
+				t.Fatal("Verify accepted a malformed hash")
+			}
+			if errors.Is(err, ErrMismatch) && !strings.HasPrefix(test.hash, "$2") {
+				t.Errorf("Verify = ErrMismatch, want an error about the hash itself")
+			}
+			if !cheapArgon2id().NeedsRehash(test.hash) {
+				t.Error("NeedsRehash is false for a malformed hash")
+			}
+		})
+	}
+}
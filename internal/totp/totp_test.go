@@ -0,0 +1,143 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed from RFC 6238 appendix B, "12345678901234567890"
+// in ASCII, encoded as base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors are the SHA-1 test vectors from RFC 6238 appendix B. The RFC
+// lists 8 digit codes, so these are their last 6 digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, vector := range rfcVectors {
+		code, err := Code(rfcSecret, Step(time.Unix(vector.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", vector.unix, err)
+		}
+		if code != vector.code {
+			t.Errorf("Code at %d = %q, want %q", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	code, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Errorf("Code = %q, want %q", code, "287082")
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code accepted a secret that isn't base32")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, vector := range rfcVectors {
+		now := time.Unix(vector.unix, 0)
+		step, ok := Validate(rfcSecret, vector.code, now, 1)
+		if !ok {
+			t.Errorf("Validate rejected %q at %d", vector.code, vector.unix)
+			continue
+		}
+		if step != Step(now) {
+			t.Errorf("Validate at %d matched step %d, want %d", vector.unix, step, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 1111111109 is the last second of its step, and 1111111111 is in the
+	// next one, so this lands right on a step boundary
+	issued := time.Unix(1111111109, 0)
+	code := "081804"
+	period := int64(Period.Seconds())
+
+	tests := []struct {
+		name   string
+		offset int64
+		skew   int64
+		ok     bool
+	}{
+		{"same step", 0, 1, true},
+		{"first second of the next step", 1, 1, true},
+		{"last second of the next step", period, 1, true},
+		{"two steps later", period + 1, 1, false},
+		{"first second of the step before", 1 - 2*period, 1, true},
+		{"two steps earlier", -2 * period, 1, false},
+		{"next step without skew", 1, 0, false},
+		{"two steps later with more skew", period + 1, 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, code, issued.Add(time.Duration(test.offset)*time.Second), test.skew)
+			if ok != test.ok {
+				t.Fatalf("Validate = %v, want %v", ok, test.ok)
+			}
+			if ok && step != Step(issued) {
+				t.Errorf("Validate matched step %d, want %d", step, Step(issued))
+			}
+		})
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{"empty code", rfcSecret, ""},
+		{"short code", rfcSecret, "28708"},
+		{"the RFC's 8 digit code", rfcSecret, "94287082"},
+		{"wrong code", rfcSecret, "287083"},
+		{"invalid secret", "not base32!", "287082"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := Validate(test.secret, test.code, now, 1); ok {
+				t.Errorf("Validate accepted %q", test.code)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 0); err != nil {
+		t.Errorf("generated secret %q doesn't decode: %v", secret, err)
+	}
+
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == other {
+		t.Error("GenerateSecret returned the same secret twice")
+	}
+}
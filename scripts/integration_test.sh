@@ -5,15 +5,17 @@ echo "Starting integration tests"
 
 host="${HOST:-https://chat.aaronbatilo.dev}"
 
-username=$(openssl rand -base64 12)
+username=$(openssl rand -hex 8)
 password=$(openssl rand -base64 12)
 
 echo "Creating a user..."
-user_id=$(curl -s --cookie-jar /tmp/cj --data "{\"username\":\"${username}\", \"password\":\"${password}\"}" --cookie /tmp/cj "${host}/users" | jq -r '.id')
+user_id=$(curl -s --data "{\"username\":\"${username}\", \"password\":\"${password}\", \"email\":\"${username}@example.com\"}" "${host}/users" | jq -r '.id')
 echo "Created user ${user_id}"
 
-echo "Logging in to get a valid session token..."
-token=$(curl -s --cookie-jar /tmp/cj --data "{\"username\":\"${username}\", \"password\":\"${password}\"}" --cookie /tmp/cj "${host}/login" | jq -r '.token')
+echo "Logging in to get a bearer token..."
+login=$(curl -s --data "{\"username\":\"${username}\", \"password\":\"${password}\"}" "${host}/login")
+token=$(echo "${login}" | jq -r '.token')
+refresh_token=$(echo "${login}" | jq -r '.refresh_token')
 echo "Login was successful. We can send requests with ${token}"
 
 
@@ -23,23 +25,98 @@ do
   if [ "${message_type}" == "0" ]; then
     echo "Creating text message..."
     text=$(openssl rand -base64 12)
-    curl -H"Authorization: ${token}" --cookie-jar /tmp/cj --cookie /tmp/cj --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"text\",\"text\":\"${text}\"}}" "${host}/messages"
+    curl -H"Authorization: Bearer ${token}" --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"text\",\"text\":\"${text}\"}}" "${host}/messages"
   fi
 
   if [ "${message_type}" == "1" ]; then
     echo "Creating image message..."
-    url=$(openssl rand -base64 12)
+    url="https://example.com/$(openssl rand -hex 8).png"
     width=$(echo $(( $RANDOM % 99 + 1 )))
     height=$(echo $(( $RANDOM % 99 + 1 )))
-    curl -H"Authorization: ${token}" --cookie-jar /tmp/cj --cookie /tmp/cj --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"image\",\"url\":\"${url}\", \"width\": ${width}, \"height\": ${height}}}" "${host}/messages"
+    curl -H"Authorization: Bearer ${token}" --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"image\",\"url\":\"${url}\", \"width\": ${width}, \"height\": ${height}}}" "${host}/messages"
   fi
 
   if [ "${message_type}" == "2" ]; then
     echo "Create video message..."
-    url=$(openssl rand -base64 12)
-    curl -H"Authorization: ${token}" --cookie-jar /tmp/cj --cookie /tmp/cj --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"video\",\"url\":\"${url}\", \"source\": \"youtube\"}}" "${host}/messages"
+    url="https://www.youtube.com/watch?v=$(openssl rand -hex 6)"
+    curl -H"Authorization: Bearer ${token}" --data "{\"sender\":${user_id}, \"recipient\": 1, \"content\":{\"type\":\"video\",\"url\":\"${url}\", \"source\": \"youtube\"}}" "${host}/messages"
   fi
 done
 
-start=$(echo $(( $RANDOM % 500 + 1 )))
-curl -s -X GET -H"Authorization: ${token}" --cookie-jar /tmp/cj --cookie /tmp/cj --data "{\"recipient\": 1, \"start\": ${start}, \"limit\": 100}" "${host}/messages" | jq -c '.messages[]'
+echo "Paging backward from the newest messages..."
+page=$(curl -s -H"Authorization: Bearer ${token}" "${host}/messages?recipient=1&limit=5")
+echo "${page}" | jq -c '.messages[]'
+prev_cursor=$(echo "${page}" | jq -r '.prev_cursor')
+if [ "${prev_cursor}" != "null" ]; then
+  curl -s -H"Authorization: Bearer ${token}" "${host}/messages?recipient=1&limit=5&cursor=${prev_cursor}" | jq -c '.messages[]'
+fi
+
+echo "Creating a group conversation..."
+conversation_id=$(curl -s -H"Authorization: Bearer ${token}" --data "{\"name\":\"integration test\", \"members\": [1]}" "${host}/conversations" | jq -r '.id')
+echo "Created conversation ${conversation_id}"
+
+text=$(openssl rand -base64 12)
+message_id=$(curl -s -H"Authorization: Bearer ${token}" --data "{\"content\":{\"type\":\"text\",\"text\":\"${text}\"}}" "${host}/conversations/${conversation_id}/messages" | jq -r '.id')
+curl -s -H"Authorization: Bearer ${token}" "${host}/conversations/${conversation_id}/messages" | jq -c '.messages[]'
+
+echo "Editing message ${message_id}..."
+curl -s -X PATCH -H"Authorization: Bearer ${token}" --data "{\"text\":\"${text} (edited)\"}" "${host}/messages/${message_id}"
+curl -s -H"Authorization: Bearer ${token}" "${host}/messages/${message_id}/revisions" | jq -c '.revisions[]'
+curl -s -H"Authorization: Bearer ${token}" "${host}/conversations" | jq -c '.conversations[]'
+
+echo "Reacting to message ${message_id}..."
+curl -s -H"Authorization: Bearer ${token}" --data '{"emoji":"👍"}' "${host}/messages/${message_id}/reactions"
+curl -s -H"Authorization: Bearer ${token}" --data '{"emoji":"🎉"}' "${host}/messages/${message_id}/reactions"
+curl -s -o /dev/null -w "%{http_code}\n" -X DELETE -H"Authorization: Bearer ${token}" "${host}/messages/${message_id}/reactions/%F0%9F%8E%89"
+curl -s -H"Authorization: Bearer ${token}" "${host}/conversations/${conversation_id}/messages" | jq -c '.messages[] | select(.reactions)'
+
+echo "Replying to message ${message_id} and reading its thread..."
+reply_id=$(curl -s -H"Authorization: Bearer ${token}" --data "{\"reply_to\":${message_id},\"content\":{\"type\":\"text\",\"text\":\"a reply\"}}" "${host}/conversations/${conversation_id}/messages" | jq -r '.id')
+curl -s -H"Authorization: Bearer ${token}" --data "{\"reply_to\":${reply_id},\"content\":{\"type\":\"text\",\"text\":\"a reply to the reply\"}}" "${host}/conversations/${conversation_id}/messages"
+curl -s -H"Authorization: Bearer ${token}" "${host}/messages/${reply_id}/thread" | jq -c '{root: .root.id, reply_count: .root.reply_count, replies: [.messages[] | {id, reply_to: .reply_to.id, thread}]}'
+
+echo "Marking the group conversation as read..."
+curl -s -H"Authorization: Bearer ${token}" --data "{\"conversation\":${conversation_id},\"message\":${reply_id}}" "${host}/messages/read"
+curl -s -H"Authorization: Bearer ${token}" "${host}/unread" | jq -c '.'
+
+echo "Uploading a file and sending it to the group conversation..."
+openssl rand -base64 96 > /tmp/integration-upload.txt
+blob_id=$(curl -s -H"Authorization: Bearer ${token}" -H"Content-Type: text/plain" --data-binary @/tmp/integration-upload.txt "${host}/blobs?filename=upload.txt" | jq -r '.id')
+curl -s -H"Authorization: Bearer ${token}" --data "{\"content\":{\"type\":\"file\",\"blob\":\"${blob_id}\"}}" "${host}/conversations/${conversation_id}/messages"
+curl -s -H"Authorization: Bearer ${token}" "${host}/blobs/${blob_id}" | diff - /tmp/integration-upload.txt && echo "Downloaded ${blob_id}"
+
+echo "Deleting messages for me and for everyone..."
+hidden_id=$(curl -s -H"Authorization: Bearer ${token}" --data "{\"content\":{\"type\":\"text\",\"text\":\"only for me\"}}" "${host}/conversations/${conversation_id}/messages" | jq -r '.id')
+curl -s -o /dev/null -w "%{http_code}\n" -X DELETE -H"Authorization: Bearer ${token}" "${host}/messages/${hidden_id}?for=me"
+curl -s -o /dev/null -w "%{http_code}\n" -X DELETE -H"Authorization: Bearer ${token}" "${host}/messages/${message_id}?for=everyone"
+curl -s -H"Authorization: Bearer ${token}" "${host}/conversations/${conversation_id}/messages" | jq -c '.messages[]'
+
+echo "Starting a sign in with the OpenID Connect provider..."
+curl -s -o /dev/null -w "%{http_code} %{redirect_url}\n" "${host}/auth/oidc/login"
+
+echo "Posting a message as a service account with an API key..."
+bot_id=$(curl -s -H"Authorization: Bearer ${token}" --data "{\"username\":\"bot-$(openssl rand -hex 4)\"}" "${host}/service-accounts" | jq -r '.id')
+api_key=$(curl -s -H"Authorization: Bearer ${token}" --data '{"name":"integration test","scopes":["messages:write","messages:read"]}' "${host}/service-accounts/${bot_id}/keys" | jq -r '.key')
+curl -s -H"Authorization: Bearer ${api_key}" --data "{\"recipient\":1,\"content\":{\"type\":\"text\",\"text\":\"beep\"}}" "${host}/messages"
+curl -s -H"Authorization: Bearer ${token}" "${host}/service-accounts/${bot_id}/keys" | jq -c '.api_keys[]'
+
+echo "Checking that regular users can't use admin endpoints..."
+curl -s -o /dev/null -w "%{http_code}\n" -H"Authorization: Bearer ${token}" "${host}/admin/users"
+
+echo "Rotating the access token with the refresh token..."
+refreshed=$(curl -s --data "{\"refresh_token\":\"${refresh_token}\"}" "${host}/token/refresh")
+token=$(echo "${refreshed}" | jq -r '.token')
+refresh_token=$(echo "${refreshed}" | jq -r '.refresh_token')
+
+echo "Changing the password..."
+new_password=$(openssl rand -base64 12)
+curl -s -X PUT -H"Authorization: Bearer ${token}" --data "{\"current_password\":\"${password}\", \"new_password\":\"${new_password}\"}" "${host}/users/me/password"
+password="${new_password}"
+
+echo "Requesting a password reset..."
+curl -s -o /dev/null -w "%{http_code}\n" --data "{\"email\":\"${username}@example.com\"}" "${host}/password-reset"
+
+echo "Listing sessions and logging out..."
+curl -s -H"Authorization: Bearer ${token}" "${host}/sessions" | jq -c '.sessions[]'
+curl -s -X POST -H"Authorization: Bearer ${token}" "${host}/logout"
+curl -s -o /dev/null -w "%{http_code}\n" -H"Authorization: Bearer ${token}" "${host}/sessions"